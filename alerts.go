@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Timeout of each alert notification sent to a webhook
+const alertNotificationTimeout = 10 * time.Second
+
+// Operators of alert conditions. Two character operators come first so they are matched before their prefixes.
+var alertOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// Struct for entries of the alerts list of a query in yaml file
+type AlertConfig struct {
+	// Comparison of the query result with a threshold, e.g. "> 1000"
+	Condition string `yaml:"condition" json:"condition" toml:"condition"`
+	Severity  string `yaml:"severity" json:"severity" toml:"severity"`
+	// Text of the alert, rendered as a Go text/template with the fields of alertMessageData
+	Message string `yaml:"message" json:"message" toml:"message"`
+	// Webhook the alert is POSTed to as JSON when the condition becomes true
+	Notification_URL string `yaml:"notification_url" json:"notification_url" toml:"notification_url"`
+	// Slack incoming webhook the alert is posted to as a message
+	Slack_Webhook_URL string `yaml:"slack_webhook_url" json:"slack_webhook_url" toml:"slack_webhook_url"`
+	// Optional interval at which an alert is sent again while its condition stays true. Zero sends it once.
+	Repeat_Interval time.Duration `yaml:"repeat_interval" json:"repeat_interval" toml:"repeat_interval"`
+	// Optional minimum number of minutes between two notifications of the alert, so flapping results don't spam
+	Cooldown_Minutes int `yaml:"cooldown_minutes" json:"cooldown_minutes" toml:"cooldown_minutes"`
+}
+
+// alertMessageData is the data the message of an alert is rendered with, e.g. {{.QueryName}} is {{.Value}}.
+type alertMessageData struct {
+	QueryName string
+	Database  string
+	Severity  string
+	Condition string
+	Value     float64
+	Threshold float64
+	Labels    map[string]string
+}
+
+// renderAlertMessage renders the message of an alert with data.
+func renderAlertMessage(message string, data alertMessageData) (string, error) {
+	tmpl, err := template.New("message").Option("missingkey=error").Parse(message)
+	if err != nil {
+		return "", fmt.Errorf("error parsing alert message: %w", err)
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("error rendering alert message: %w", err)
+	}
+	return rendered.String(), nil
+}
+
+// alertCondition is a parsed alert condition.
+type alertCondition struct {
+	operator  string
+	threshold float64
+}
+
+// parseAlertCondition parses a condition made of an operator and a threshold, such as "> 1000".
+func parseAlertCondition(condition string) (alertCondition, error) {
+	condition = strings.TrimSpace(condition)
+	for _, operator := range alertOperators {
+		if !strings.HasPrefix(condition, operator) {
+			continue
+		}
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(condition[len(operator):]), 64)
+		if err != nil {
+			return alertCondition{}, fmt.Errorf("invalid threshold in condition %q: %w", condition, err)
+		}
+		return alertCondition{operator: operator, threshold: threshold}, nil
+	}
+	return alertCondition{}, fmt.Errorf("condition %q must start with one of %s", condition, strings.Join(alertOperators, ", "))
+}
+
+// matches reports whether value satisfies the condition.
+func (c alertCondition) matches(value float64) bool {
+	switch c.operator {
+	case ">=":
+		return value >= c.threshold
+	case "<=":
+		return value <= c.threshold
+	case "==":
+		return value == c.threshold
+	case "!=":
+		return value != c.threshold
+	case ">":
+		return value > c.threshold
+	default:
+		return value < c.threshold
+	}
+}
+
+// Values of the status of alert notifications, as in Alertmanager
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// Receiver named in the Alertmanager webhook payloads
+const alertReceiver = "mysql_query_exporter"
+
+// alertNotification is a notification of an alert of a query result, sent to the webhooks of the alert.
+type alertNotification struct {
+	Status    string
+	QueryName string
+	Database  string
+	Severity  string
+	Message   string
+	Condition string
+	Threshold float64
+	Value     float64
+	// Row, column and extra labels of the result
+	Labels map[string]string
+	// When the alert started firing and, for resolved alerts, when it stopped
+	StartsAt time.Time
+	EndsAt   time.Time
+}
+
+// alertmanagerMessage is the payload of an Alertmanager webhook, so notification_url can be any receiver
+// accepting Alertmanager notifications.
+type alertmanagerMessage struct {
+	Version           string              `json:"version"`
+	GroupKey          string              `json:"groupKey"`
+	TruncatedAlerts   int                 `json:"truncatedAlerts"`
+	Status            string              `json:"status"`
+	Receiver          string              `json:"receiver"`
+	GroupLabels       map[string]string   `json:"groupLabels"`
+	CommonLabels      map[string]string   `json:"commonLabels"`
+	CommonAnnotations map[string]string   `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	Alerts            []alertmanagerAlert `json:"alerts"`
+}
+
+// alertmanagerAlert is an alert of an Alertmanager webhook payload.
+type alertmanagerAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// buildAlertmanagerPayload returns the Alertmanager webhook payload of alertCfg firing now for a result of query,
+// labeled with the extra labels of the query. Notifications of row and column results and resolved alerts
+// are encoded by alertmanagerPayload.
+func buildAlertmanagerPayload(query Query, value float64, alertCfg AlertConfig) []byte {
+	// The conditions have been validated with the config
+	condition, _ := parseAlertCondition(alertCfg.Condition)
+	notification := newAlertNotification(query, query.Database, alertCfg, condition, value, query.Extra_Labels)
+	notification.Status, notification.StartsAt = alertFiring, time.Now()
+	return alertmanagerPayload(notification)
+}
+
+// alertmanagerPayload encodes a notification as Alertmanager webhook payload. The alert is labeled with
+// the query name as alertname, its severity and the labels of the result, and annotated with the message,
+// value, condition, threshold and database.
+func alertmanagerPayload(notification alertNotification) []byte {
+	labels := map[string]string{"alertname": notification.QueryName}
+	for name, value := range notification.Labels {
+		labels[name] = value
+	}
+	if notification.Severity != "" {
+		labels["severity"] = notification.Severity
+	}
+
+	annotations := map[string]string{
+		"value":     strconv.FormatFloat(notification.Value, 'g', -1, 64),
+		"condition": notification.Condition,
+		"threshold": strconv.FormatFloat(notification.Threshold, 'g', -1, 64),
+	}
+	if notification.Message != "" {
+		annotations["summary"] = notification.Message
+	}
+	if notification.Database != "" {
+		annotations["database"] = notification.Database
+	}
+
+	alert := alertmanagerAlert{
+		Status:      notification.Status,
+		Labels:      labels,
+		Annotations: annotations,
+		StartsAt:    notification.StartsAt,
+		EndsAt:      notification.EndsAt,
+		Fingerprint: fmt.Sprintf("%016x", model.LabelsToSignature(labels)),
+	}
+	groupLabels := map[string]string{"alertname": notification.QueryName}
+
+	// Maps of strings and times always encode
+	payload, _ := json.Marshal(alertmanagerMessage{
+		Version:           "4",
+		GroupKey:          fmt.Sprintf("{}:{alertname=%q}", notification.QueryName),
+		Status:            notification.Status,
+		Receiver:          alertReceiver,
+		GroupLabels:       groupLabels,
+		CommonLabels:      labels,
+		CommonAnnotations: annotations,
+		Alerts:            []alertmanagerAlert{alert},
+	})
+	return payload
+}
+
+// slackMessage is the payload of a Slack incoming webhook.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// newSlackMessage formats a notification as Slack message.
+func newSlackMessage(notification alertNotification) slackMessage {
+	var text strings.Builder
+	if notification.Status == alertResolved {
+		text.WriteString("[RESOLVED] ")
+	}
+	if notification.Severity != "" {
+		fmt.Fprintf(&text, "[%s] ", strings.ToUpper(notification.Severity))
+	}
+	fmt.Fprintf(&text, "*%s*", notification.QueryName)
+	if notification.Message != "" {
+		fmt.Fprintf(&text, ": %s", notification.Message)
+	}
+	fmt.Fprintf(&text, "\nValue: %g (condition %s, threshold %g)", notification.Value, notification.Condition, notification.Threshold)
+	if notification.Database != "" {
+		fmt.Fprintf(&text, "\nDatabase: %s", notification.Database)
+	}
+	for _, name := range sortedKeys(notification.Labels) {
+		fmt.Fprintf(&text, "\n%s: %s", name, notification.Labels[name])
+	}
+	return slackMessage{Text: text.String()}
+}
+
+// alertState is the state of an alert of a single query result.
+type alertState struct {
+	// Whether the condition matched the last result and the alert was sent
+	firing bool
+	// When the alert started firing and when it was last sent, zero if it wasn't sent yet
+	started time.Time
+	sent    time.Time
+}
+
+// alertNotifier evaluates the alerts of the queries against their results and sends the notifications.
+// An alert is only sent when its condition becomes true, and again every repeat_interval while it stays true.
+// No alert is sent within cooldown_minutes of the previous notification. Once the condition of a sent alert
+// is false again, it is sent as resolved.
+type alertNotifier struct {
+	client *http.Client
+
+	mu sync.Mutex
+	// State of every alert, keyed by query name, alert index and result labels
+	states map[string]alertState
+}
+
+// Notifier of the query alerts, nil when alerts are not evaluated, such as with -once
+var queryAlerts *alertNotifier
+
+// newAlertNotifier returns an alertNotifier with no firing alerts.
+func newAlertNotifier() *alertNotifier {
+	return &alertNotifier{
+		client: &http.Client{Timeout: alertNotificationTimeout},
+		states: make(map[string]alertState),
+	}
+}
+
+// evaluate checks the alerts of a query against a result read from the database key and exported with labels,
+// and sends the alerts which fire. It does nothing when n is nil.
+func (n *alertNotifier) evaluate(key dbKey, conf Query, value float64, labels map[string]string) {
+	if n == nil || len(conf.Alerts) == 0 {
+		return
+	}
+
+	// Alerts of results with different labels, such as the rows of a multi row query, fire independently
+	series := make([]string, 0, len(labels))
+	for _, name := range sortedKeys(labels) {
+		series = append(series, name+"="+labels[name])
+	}
+
+	now := time.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, alert := range conf.Alerts {
+		// The conditions have been validated with the config
+		condition, err := parseAlertCondition(alert.Condition)
+		if err != nil {
+			continue
+		}
+
+		stateKey := strings.Join(append([]string{conf.Name, strconv.Itoa(i)}, series...), "\xff")
+		state := n.states[stateKey]
+		if !condition.matches(value) {
+			if state.firing {
+				notification := newAlertNotification(conf, key.Database, alert, condition, value, labels)
+				notification.Status, notification.StartsAt, notification.EndsAt = alertResolved, state.started, now
+				go n.send(stateKey, alert, notification)
+			}
+			state.firing = false
+			n.states[stateKey] = state
+			continue
+		}
+
+		// Alerts which keep firing are only repeated every repeat_interval. Alerts due within the cooldown
+		// are sent with the first result after it.
+		due := !state.firing || (alert.Repeat_Interval > 0 && now.Sub(state.sent) >= alert.Repeat_Interval)
+		cooling := !state.sent.IsZero() && now.Sub(state.sent) < time.Duration(alert.Cooldown_Minutes)*time.Minute
+		if !due || cooling {
+			continue
+		}
+		if !state.firing {
+			state.started = now
+		}
+		state.firing, state.sent = true, now
+		n.states[stateKey] = state
+
+		notification := newAlertNotification(conf, key.Database, alert, condition, value, labels)
+		notification.Status, notification.StartsAt = alertFiring, state.started
+		go n.send(stateKey, alert, notification)
+	}
+}
+
+// newAlertNotification returns the notification of an alert of a query result read from database, with its message
+// rendered. The status and times are left to the caller.
+func newAlertNotification(conf Query, database string, alert AlertConfig, condition alertCondition, value float64, labels map[string]string) alertNotification {
+	data := alertMessageData{
+		QueryName: conf.Name,
+		Database:  database,
+		Severity:  alert.Severity,
+		Condition: alert.Condition,
+		Value:     value,
+		Threshold: condition.threshold,
+		Labels:    labels,
+	}
+	message, err := renderAlertMessage(alert.Message, data)
+	if err != nil {
+		queryLogger(conf).Error("Error rendering alert message, sending it unrendered", "error", err)
+		message = alert.Message
+	}
+
+	return alertNotification{
+		QueryName: conf.Name,
+		Database:  database,
+		Severity:  alert.Severity,
+		Message:   message,
+		Condition: alert.Condition,
+		Threshold: condition.threshold,
+		Value:     value,
+		Labels:    labels,
+	}
+}
+
+// send sends a notification to the webhook and Slack webhook of alert.
+// When a firing alert can't be sent it is sent again with the next result.
+func (n *alertNotifier) send(key string, alert AlertConfig, notification alertNotification) {
+	logger := slog.With("query_name", notification.QueryName, "condition", notification.Condition, "status", notification.Status)
+
+	var err error
+	if alert.Notification_URL != "" {
+		err = postAlert(n.client, alert.Notification_URL, alertmanagerPayload(notification))
+	}
+	if alert.Slack_Webhook_URL != "" {
+		body, slackErr := json.Marshal(newSlackMessage(notification))
+		if slackErr == nil {
+			slackErr = postAlert(n.client, alert.Slack_Webhook_URL, body)
+		}
+		err = errors.Join(err, slackErr)
+	}
+
+	if err != nil {
+		logger.Error("Error sending alert", "error", err)
+
+		n.mu.Lock()
+		delete(n.states, key)
+		n.mu.Unlock()
+		return
+	}
+	logger.Info("Sent alert", "value", notification.Value)
+}
+
+// postAlert POSTs the JSON body of an alert notification to url.
+func postAlert(client *http.Client, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), alertNotificationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating alert request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting alert to %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error posting alert to %s: unexpected status %s", url, resp.Status)
+	}
+	return nil
+}
+
+// forget drops the firing alerts of a removed query, so they fire again once it is added back.
+// It does nothing when n is nil.
+func (n *alertNotifier) forget(name string) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	prefix := name + "\xff"
+	for key := range n.states {
+		if strings.HasPrefix(key, prefix) {
+			delete(n.states, key)
+		}
+	}
+}
+
+// sortedKeys returns the keys of m in increasing order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
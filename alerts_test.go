@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAlertReceiver starts an HTTP server recording the bodies of the requests it receives, closed at the end of the test.
+func startAlertReceiver(t *testing.T) (*httptest.Server, <-chan []byte) {
+	t.Helper()
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s request with content type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		bodies <- body
+	}))
+	t.Cleanup(server.Close)
+	return server, bodies
+}
+
+// receiveAlert returns the next body received by an alert receiver, failing the test if none arrives in time.
+func receiveAlert(t *testing.T, bodies <-chan []byte) []byte {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert received")
+		return nil
+	}
+}
+
+func TestAlertNotifierSlack(t *testing.T) {
+	server, bodies := startAlertReceiver(t)
+	// The database comes from the connection of the query, which doesn't name one itself
+	conf := Query{
+		Name:       "pending_orders",
+		Connection: "shop_primary",
+		Alerts: []AlertConfig{{
+			Condition:         "> 100",
+			Severity:          "warning",
+			Message:           "{{.Value}} orders are pending",
+			Slack_Webhook_URL: server.URL,
+			Cooldown_Minutes:  10,
+		}},
+	}
+	notifier := newAlertNotifier()
+	key := dbKey{Connection: conf.Connection, Database: "shop"}
+
+	notifier.evaluate(key, conf, 150, map[string]string{"region": "eu"})
+	var message slackMessage
+	if err := json.Unmarshal(receiveAlert(t, bodies), &message); err != nil {
+		t.Fatal(err)
+	}
+	want := "[WARNING] *pending_orders*: 150 orders are pending\nValue: 150 (condition > 100, threshold 100)\nDatabase: shop\nregion: eu"
+	if message.Text != want {
+		t.Errorf("got Slack message %q, want %q", message.Text, want)
+	}
+
+	// Resolved alerts are sent right away, but the alert firing again falls within the cooldown of the first notification
+	notifier.evaluate(key, conf, 50, map[string]string{"region": "eu"})
+	if err := json.Unmarshal(receiveAlert(t, bodies), &message); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(message.Text, "[RESOLVED] ") {
+		t.Errorf("got Slack message %q, want a resolved alert", message.Text)
+	}
+	notifier.evaluate(key, conf, 200, map[string]string{"region": "eu"})
+	select {
+	case body := <-bodies:
+		t.Errorf("got alert %s during the cooldown", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBuildAlertmanagerPayload(t *testing.T) {
+	conf := Query{
+		Name:         "failed_logins",
+		Database:     "auth",
+		Extra_Labels: map[string]string{"team": "security"},
+	}
+	alert := AlertConfig{Condition: ">= 10", Severity: "critical", Message: "{{.Value}} failed logins in {{.Database}}"}
+
+	before := time.Now()
+	var message alertmanagerMessage
+	if err := json.Unmarshal(buildAlertmanagerPayload(conf, 12, alert), &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Version != "4" || message.Status != alertFiring || message.Receiver != alertReceiver {
+		t.Errorf("got version %q, status %q and receiver %q", message.Version, message.Status, message.Receiver)
+	}
+	if len(message.Alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(message.Alerts))
+	}
+	got := message.Alerts[0]
+
+	wantLabels := map[string]string{"alertname": "failed_logins", "severity": "critical", "team": "security"}
+	if !maps.Equal(got.Labels, wantLabels) {
+		t.Errorf("got labels %v, want %v", got.Labels, wantLabels)
+	}
+	wantAnnotations := map[string]string{
+		"summary":   "12 failed logins in auth",
+		"value":     "12",
+		"condition": ">= 10",
+		"threshold": "10",
+		"database":  "auth",
+	}
+	if !maps.Equal(got.Annotations, wantAnnotations) {
+		t.Errorf("got annotations %v, want %v", got.Annotations, wantAnnotations)
+	}
+	if got.StartsAt.Before(before.Truncate(time.Second)) || got.StartsAt.After(time.Now()) {
+		t.Errorf("got startsAt %s, want the current time", got.StartsAt)
+	}
+	if !got.EndsAt.IsZero() {
+		t.Errorf("got endsAt %s for a firing alert, want none", got.EndsAt)
+	}
+	if got.Status != alertFiring || got.Fingerprint == "" {
+		t.Errorf("got status %q and fingerprint %q", got.Status, got.Fingerprint)
+	}
+}
+
+func TestAlertNotifierAlertmanager(t *testing.T) {
+	server, bodies := startAlertReceiver(t)
+	conf := Query{
+		Name:   "replication_lag",
+		Alerts: []AlertConfig{{Condition: "> 30", Notification_URL: server.URL}},
+	}
+	notifier := newAlertNotifier()
+	labels := map[string]string{"replica": "db2"}
+	key := dbKey{Database: "replicas"}
+
+	notifier.evaluate(key, conf, 45, labels)
+	var firing alertmanagerMessage
+	if err := json.Unmarshal(receiveAlert(t, bodies), &firing); err != nil {
+		t.Fatal(err)
+	}
+	notifier.evaluate(key, conf, 5, labels)
+	var resolved alertmanagerMessage
+	if err := json.Unmarshal(receiveAlert(t, bodies), &resolved); err != nil {
+		t.Fatal(err)
+	}
+
+	if firing.Status != alertFiring || resolved.Status != alertResolved {
+		t.Errorf("got statuses %q and %q, want firing and resolved", firing.Status, resolved.Status)
+	}
+	first, last := firing.Alerts[0], resolved.Alerts[0]
+	if first.Labels["replica"] != "db2" || first.Labels["alertname"] != "replication_lag" {
+		t.Errorf("got labels %v, want the query name and result labels", first.Labels)
+	}
+	if first.Annotations["database"] != "replicas" {
+		t.Errorf("got database annotation %q, want the database the query ran on", first.Annotations["database"])
+	}
+	if !first.EndsAt.IsZero() {
+		t.Errorf("got endsAt %s for the firing alert, want none", first.EndsAt)
+	}
+	if !last.StartsAt.Equal(first.StartsAt) || last.EndsAt.Before(last.StartsAt) {
+		t.Errorf("resolved alert runs from %s to %s, want from %s", last.StartsAt, last.EndsAt, first.StartsAt)
+	}
+	if first.Fingerprint != last.Fingerprint {
+		t.Errorf("got fingerprints %s and %s, want the same alert", first.Fingerprint, last.Fingerprint)
+	}
+}
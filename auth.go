@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuth wraps next with HTTP basic authentication. Requests are only passed on when their username
+// matches username and their password matches the bcrypt passwordHash, other requests are answered with 401.
+// When username is empty authentication is disabled and next is returned unchanged.
+func basicAuth(next http.Handler, username string, passwordHash string) http.Handler {
+	if username == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+
+		// Always compare the password so unknown usernames take as long to reject as wrong passwords
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passwordOK := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) == nil
+
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mysql_query_exporter", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hashPassword reads a password from the first line of in and writes its bcrypt hash to out,
+// ready to be used as web_auth_password_hash.
+func hashPassword(in io.Reader, out io.Writer) error {
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error reading password: %w", err)
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+
+	_, err = fmt.Fprintln(out, string(hash))
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Numbers of queries and series the benchmarks are run with, to show how they scale
+var benchmarkSizes = []int{1, 10, 100, 1000}
+
+// benchmarkConfig returns a YAML config with n queries.
+func benchmarkConfig(n int) string {
+	var config strings.Builder
+	config.WriteString("exporter_port: 2112\ndb_host: db.example.com\ndb_port: 3306\ndb_user: exporter\nqueries:\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&config, "  - name: query_%d\n    query: SELECT COUNT(*) FROM table_%d WHERE status = 'active'\n    interval: 30s\n    extra_labels:\n      team: team_%d\n", i, i, i%10)
+	}
+	return config.String()
+}
+
+func BenchmarkReadConfig(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		path := writeTestConfig(b, "*.yaml", benchmarkConfig(n))
+		b.Run(fmt.Sprintf("queries=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := readConfig(path, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkQueries returns n queries exported on the shared gauge, whose series are deleted at the end of the benchmark.
+func benchmarkQueries(b *testing.B, n int) []Query {
+	b.Helper()
+	queries := make([]Query, n)
+	for i := range queries {
+		queries[i] = Query{Name: fmt.Sprintf("bench_query_%d", i), Query: "SELECT 1"}
+	}
+	b.Cleanup(func() {
+		for _, conf := range queries {
+			deleteQueryMetrics(conf)
+		}
+	})
+	return queries
+}
+
+func BenchmarkCheckQueryMetricEmission(b *testing.B) {
+	key := dbKey{Host: "db.example.com", Port: 3306, Database: "app"}
+	for _, n := range benchmarkSizes {
+		queries := benchmarkQueries(b, n)
+		// Create every series before measuring, so the lookups run against n registered series
+		for _, conf := range queries {
+			exportQueryResult(context.Background(), key, conf, 0)
+		}
+
+		// The label values exportQueryResult sets, depending on the query and database labels
+		labelValues := make([][]string, n)
+		for i, conf := range queries {
+			labelValues[i] = []string{conf.Name}
+			if queryLabelEnabled {
+				labelValues[i] = append(labelValues[i], conf.Query)
+			}
+			if dbLabelsEnabled {
+				labelValues[i] = append(labelValues[i], key.host(), key.Database)
+			}
+		}
+
+		b.Run(fmt.Sprintf("series=%d/WithLabelValues", n), func(b *testing.B) {
+			gauge := queryGauge(queries[0])
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				gauge.WithLabelValues(labelValues[i%n]...).Set(float64(i))
+			}
+		})
+		b.Run(fmt.Sprintf("series=%d/exportQueryResult", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				exportQueryResult(context.Background(), key, queries[i%n], float64(i))
+			}
+		})
+	}
+}
+
+// benchmarkRegistry returns a registry with a gauge of n series, one per query named query_<i>.
+func benchmarkRegistry(n int) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "mysql_query_result", Help: "Benchmark gauge."}, []string{"name", "team"})
+	registry.MustRegister(gauge)
+	for i := 0; i < n; i++ {
+		gauge.WithLabelValues(fmt.Sprintf("query_%d", i), fmt.Sprintf("team_%d", i%10)).Set(float64(i))
+	}
+	return registry
+}
+
+func BenchmarkRelabelGatherer(b *testing.B) {
+	rules, err := compileRelabelConfigs([]RelabelConfig{
+		{Source_Labels: []string{"name"}, Regex: "query_1.*", Action: relabelDrop},
+		{Source_Labels: []string{"team"}, Target_Label: "owner", Replacement: "owner_$1", Regex: "team_(.*)"},
+		{Regex: "team", Action: relabelLabelDrop},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, n := range benchmarkSizes {
+		gatherer := &relabelGatherer{gatherer: benchmarkRegistry(n), rules: rules}
+		b.Run(fmt.Sprintf("series=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := gatherer.Gather(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkQueryFilterGatherer(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		// A listen address serving a tenth of the queries
+		queries := make(map[string]bool)
+		for i := 0; i < n; i += 10 {
+			queries[fmt.Sprintf("query_%d", i)] = true
+		}
+		gatherer := queryFilterGatherer{gatherer: benchmarkRegistry(n), queries: queries}
+		b.Run(fmt.Sprintf("series=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := gatherer.Gather(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
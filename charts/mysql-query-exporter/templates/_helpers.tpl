@@ -0,0 +1,37 @@
+{{/* Name of the chart, overridable with nameOverride */}}
+{{- define "mysql-query-exporter.name" -}}
+{{- default .Chart.Name .Values.nameOverride | trunc 63 | trimSuffix "-" }}
+{{- end }}
+
+{{/* Fully qualified name of the release resources, overridable with fullnameOverride */}}
+{{- define "mysql-query-exporter.fullname" -}}
+{{- if .Values.fullnameOverride }}
+{{- .Values.fullnameOverride | trunc 63 | trimSuffix "-" }}
+{{- else }}
+{{- $name := default .Chart.Name .Values.nameOverride }}
+{{- if contains $name .Release.Name }}
+{{- .Release.Name | trunc 63 | trimSuffix "-" }}
+{{- else }}
+{{- printf "%s-%s" .Release.Name $name | trunc 63 | trimSuffix "-" }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{/* Labels of all resources */}}
+{{- define "mysql-query-exporter.labels" -}}
+helm.sh/chart: {{ printf "%s-%s" .Chart.Name .Chart.Version | replace "+" "_" | trunc 63 | trimSuffix "-" }}
+{{ include "mysql-query-exporter.selectorLabels" . }}
+app.kubernetes.io/version: {{ .Chart.AppVersion | quote }}
+app.kubernetes.io/managed-by: {{ .Release.Service }}
+{{- end }}
+
+{{/* Labels selecting the exporter pods */}}
+{{- define "mysql-query-exporter.selectorLabels" -}}
+app.kubernetes.io/name: {{ include "mysql-query-exporter.name" . }}
+app.kubernetes.io/instance: {{ .Release.Name }}
+{{- end }}
+
+{{/* Name of the ConfigMap holding query_config.yaml */}}
+{{- define "mysql-query-exporter.configMapName" -}}
+{{- default (include "mysql-query-exporter.fullname" .) .Values.existingConfigMap }}
+{{- end }}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// checkConfig runs the check-config subcommand with the arguments following it and reports whether the
+// configuration is valid. The configuration is loaded and validated, no database is connected to.
+// With -strict the SQL of the queries running on MySQL is checked too.
+func checkConfig(args []string, out io.Writer) bool {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	flags.SetOutput(out)
+	configPath := flags.String("config", defaultConfigPath(), "path or http(s) URL of the YAML, JSON or TOML configuration file, MQCE_CONFIG sets the default")
+	configFormat := flags.String("config-format", "", "format of the configuration file: yaml, json or toml (default detected from the file extension)")
+	configAuthToken := flags.String("config-auth-token", "", "bearer token sent when fetching the configuration from a URL")
+	strict := flags.Bool("strict", false, "also check that the SQL of every MySQL query is syntactically valid")
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+
+	config, err := loadConfig(*configPath, *configFormat, *configAuthToken)
+	if err != nil {
+		fmt.Fprintf(out, "Error reading configuration file %s: %v\n", *configPath, err)
+		return false
+	}
+
+	errs := validateConfig(config)
+	if *strict {
+		errs = append(errs, checkQuerySyntax(config)...)
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(out, "Invalid configuration: %v\n", err)
+		}
+		fmt.Fprintf(out, "Found %d errors in configuration file %s\n", len(errs), *configPath)
+		return false
+	}
+
+	// Summarize what the exporter would run, under the metric names of the config
+	defaultMetricName, defaultColumnMetricName = sharedMetricNames(config)
+	databases := make(map[dbKey]bool)
+	for _, conf := range config.Queries {
+		databases[queryDBKey(config, conf)] = true
+	}
+	fmt.Fprintf(out, "OK: %s has %d queries on %d databases\n", *configPath, len(config.Queries), len(databases))
+	for _, conf := range config.Queries {
+		fmt.Fprintf(out, "  %s on %s every %s, exported as %s\n", conf.Name, queryDBKey(config, conf), conf.Interval, queryMetricName(conf))
+	}
+	return true
+}
+
+// checkQuerySyntax returns one error per query running on MySQL whose SQL is not syntactically valid.
+// Queries on other databases are skipped, as their SQL dialects differ.
+func checkQuerySyntax(config Config) []error {
+	var errs []error
+	for i, conf := range config.Queries {
+		key := queryDBKey(config, conf)
+		if key.Type != "" && key.Type != dbTypeMySQL {
+			continue
+		}
+		if len(conf.Statements) == 0 {
+			if err := checkSQLSyntax(conf.Query); err != nil {
+				errs = append(errs, fmt.Errorf("queries[%d] (%s): invalid SQL: %w", i, conf.Name, err))
+			} else if key.flavor() == dbFlavorMariaDB && mysqlOnlyStatements[firstKeyword(conf.Query)] {
+				errs = append(errs, fmt.Errorf("queries[%d] (%s): %s statements are not supported by MariaDB", i, conf.Name, firstKeyword(conf.Query)))
+			}
+			continue
+		}
+
+		// Statements which don't read rows, such as SET, aren't checked
+		for j, statement := range conf.Statements {
+			if !readStatement(statement) {
+				continue
+			}
+			if err := checkSQLSyntax(statement); err != nil {
+				errs = append(errs, fmt.Errorf("queries[%d] (%s): invalid SQL in statements[%d]: %w", i, conf.Name, j, err))
+			} else if key.flavor() == dbFlavorMariaDB && mysqlOnlyStatements[firstKeyword(statement)] {
+				errs = append(errs, fmt.Errorf("queries[%d] (%s): %s statements in statements[%d] are not supported by MariaDB", i, conf.Name, firstKeyword(statement), j))
+			}
+		}
+	}
+	return errs
+}
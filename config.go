@@ -0,0 +1,685 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Supported config file formats
+const (
+	configFormatYAML = "yaml"
+	configFormatJSON = "json"
+	configFormatTOML = "toml"
+)
+
+// Prefix of the environment variables holding defaults of the config, e.g. MQCE_DB_HOST for db_host
+const envDefaultPrefix = "MQCE_"
+
+// Matches ${VAR} references to environment variables in config values
+var envReferencePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Matches the line number starting the messages of the YAML decoder's unmarshal errors
+var yamlErrorLinePattern = regexp.MustCompile(`^line (\d+): `)
+
+// Struct for Queries in yaml file
+type Query struct {
+	Name     string        `yaml:"name" json:"name" toml:"name"`
+	Database string        `yaml:"database" json:"database" toml:"database"`
+	Query    string        `yaml:"query" json:"query" toml:"query"`
+	Interval time.Duration `yaml:"interval" json:"interval" toml:"interval"`
+	// Optional list of statements run instead of query in a single read-only transaction. Every statement returning
+	// rows is exported as <name>_<index>, other statements such as SET prepare the session for the following ones.
+	Statements []string `yaml:"statements" json:"statements" toml:"statements"`
+	// When true, the query is ignored as if it wasn't configured, e.g. while it puts too much load on the database
+	Disabled bool `yaml:"disabled" json:"disabled" toml:"disabled"`
+	// Optional names of queries which must have succeeded once before this query first runs
+	Depends_On []string `yaml:"depends_on" json:"depends_on" toml:"depends_on"`
+	// Optional name of the entry in databases the query runs on. Defaults to the top-level db_* fields.
+	Connection string `yaml:"connection" json:"connection" toml:"connection"`
+	// Optional credentials of the query, overriding the user and password of its connection,
+	// e.g. for a user only allowed to read the tables of the query
+	User     string `yaml:"user" json:"user" toml:"user"`
+	Password string `yaml:"password" json:"password" toml:"password"`
+	// Optional maximum duration of a single query execution. Zero means no timeout.
+	Query_Timeout time.Duration `yaml:"query_timeout" json:"query_timeout" toml:"query_timeout"`
+	// Alias of query_timeout, used when query_timeout is not set
+	Timeout time.Duration `yaml:"timeout" json:"timeout" toml:"timeout"`
+	// Optional maximum duration of getting a connection from the pool. Zero means no timeout.
+	Connection_Timeout time.Duration `yaml:"connection_timeout" json:"connection_timeout" toml:"connection_timeout"`
+	// Optional number of retries of a failed query and backoff before the first retry, doubled after every retry. Defaults to 1s.
+	Retry_Count   int           `yaml:"retry_count" json:"retry_count" toml:"retry_count"`
+	Retry_Backoff time.Duration `yaml:"retry_backoff" json:"retry_backoff" toml:"retry_backoff"`
+	// Optional value exported when the query result is NULL, defaults to 0
+	Null_Value float64 `yaml:"null_value" json:"null_value" toml:"null_value"`
+	// Optional arithmetic applied to every value returned by the query, such as "/ 1048576" to convert bytes to megabytes.
+	// NULL results are exported as null_value without it.
+	Transform string `yaml:"transform" json:"transform" toml:"transform"`
+	// Optional bounds of the exported values, applied after the transform. Values outside of them are
+	// exported as the bound and counted in mysql_query_value_clamped_total.
+	Clamp_Min *float64 `yaml:"clamp_min" json:"clamp_min" toml:"clamp_min"`
+	Clamp_Max *float64 `yaml:"clamp_max" json:"clamp_max" toml:"clamp_max"`
+	// Optional range the values are expected in, checked after the transform and before clamping. Values outside of it
+	// are counted in mysql_query_validation_failure_total, and not exported when skip_on_validation_failure is true.
+	Min_Expected               *float64 `yaml:"min_expected" json:"min_expected" toml:"min_expected"`
+	Max_Expected               *float64 `yaml:"max_expected" json:"max_expected" toml:"max_expected"`
+	Skip_On_Validation_Failure bool     `yaml:"skip_on_validation_failure" json:"skip_on_validation_failure" toml:"skip_on_validation_failure"`
+	// Optional random delay of the first run, as a percentage (0-100) of the interval
+	Jitter_Percent float64 `yaml:"jitter_percent" json:"jitter_percent" toml:"jitter_percent"`
+	// Optional dedicated metric name and help text. Queries without a metric name are exported as mysql_query_exporter.
+	Metric_Name string `yaml:"metric_name" json:"metric_name" toml:"metric_name"`
+	Metric_Help string `yaml:"metric_help" json:"metric_help" toml:"metric_help"`
+	// Prometheus metric type of the query result: gauge (default), counter or summary
+	Metric_Type string `yaml:"metric_type" json:"metric_type" toml:"metric_type"`
+	// Optional settings of summary queries: quantile objectives mapped to their allowed error and the sliding window
+	Summary_Objectives  map[string]float64 `yaml:"summary_objectives" json:"summary_objectives" toml:"summary_objectives"`
+	Summary_Max_Age     time.Duration      `yaml:"summary_max_age" json:"summary_max_age" toml:"summary_max_age"`
+	Summary_Age_Buckets int                `yaml:"summary_age_buckets" json:"summary_age_buckets" toml:"summary_age_buckets"`
+	// When true, every result is observed by a Prometheus native histogram instead of using metric_type.
+	// The bucket factor bounds the growth from one bucket to the next and defaults to 1.1.
+	Native_Histogram               bool    `yaml:"native_histogram" json:"native_histogram" toml:"native_histogram"`
+	Native_Histogram_Bucket_Factor float64 `yaml:"native_histogram_bucket_factor" json:"native_histogram_bucket_factor" toml:"native_histogram_bucket_factor"`
+	// When true, every row and column of the result set is exported instead of a single count.
+	// The first column of each row is used as the row label, every other column as a value.
+	Multi_Column bool `yaml:"multi_column" json:"multi_column" toml:"multi_column"`
+	// When true, every row of a two column result set is exported as its own series.
+	// The first column is exported as a label named row_label_column, the second column as the value.
+	Multi_Row        bool   `yaml:"multi_row" json:"multi_row" toml:"multi_row"`
+	Row_Label_Column string `yaml:"row_label_column" json:"row_label_column" toml:"row_label_column"`
+	// Optional maximum number of rows read from the result set of multi column and multi row queries, defaults to 1000.
+	// Further rows are skipped and counted in mysql_query_result_truncated_total.
+	Max_Query_Results int `yaml:"max_query_results" json:"max_query_results" toml:"max_query_results"`
+	// When true, the query runs in a read-only REPEATABLE READ transaction, so all tables it reads come from the same snapshot
+	Consistent_Read bool `yaml:"consistent_read" json:"consistent_read" toml:"consistent_read"`
+	// Optional SQL setting up the session before the query, such as SET SESSION TRANSACTION ISOLATION LEVEL READ UNCOMMITTED.
+	// It runs on the same connection as the query, which is closed afterwards so the settings don't affect other queries.
+	Pre_Query string `yaml:"pre_query" json:"pre_query" toml:"pre_query"`
+	// Optional static labels added to the result metric of the query, e.g. environment or region
+	Extra_Labels map[string]string `yaml:"extra_labels" json:"extra_labels" toml:"extra_labels"`
+	// Optional alerts sent to a webhook when a result of the query matches their condition
+	Alerts []AlertConfig `yaml:"alerts" json:"alerts" toml:"alerts"`
+	// Optional values the query is rendered with as a Go text/template, e.g. {{.Table}}
+	Template_Vars map[string]string `yaml:"template_vars" json:"template_vars" toml:"template_vars"`
+}
+
+// Struct for entries of the databases list in yaml file
+type DBConfig struct {
+	Name string `yaml:"name" json:"name" toml:"name"`
+	// Optional type of the database: mysql (default), postgres, sqlite or mssql
+	Type string `yaml:"type" json:"type" toml:"type"`
+	// Use Windows Authentication instead of the user and password, only supported by mssql
+	Integrated_Security bool   `yaml:"integrated_security" json:"integrated_security" toml:"integrated_security"`
+	Host                string `yaml:"host" json:"host" toml:"host"`
+	Port                int    `yaml:"port" json:"port" toml:"port"`
+	// Optional path of the Unix socket of a local MySQL server, used instead of host and port
+	Socket string `yaml:"socket" json:"socket" toml:"socket"`
+	// Send a PROXY protocol v1 header when connecting, for MySQL behind ProxySQL or HAProxy
+	Proxy_Protocol bool `yaml:"proxy_protocol" json:"proxy_protocol" toml:"proxy_protocol"`
+	// Optional flavor of MySQL databases: mysql (default) or mariadb
+	Flavor string `yaml:"flavor" json:"flavor" toml:"flavor"`
+	// Optional character set (default utf8mb4), collation and time zone (default Local) of MySQL connections
+	Charset   string `yaml:"charset" json:"charset" toml:"charset"`
+	Collation string `yaml:"collation" json:"collation" toml:"collation"`
+	Loc       string `yaml:"loc" json:"loc" toml:"loc"`
+	User      string `yaml:"user" json:"user" toml:"user"`
+	Password  string `yaml:"password" json:"password" toml:"password"`
+	// Optional default database of queries on this connection which don't set one
+	Database string `yaml:"database" json:"database" toml:"database"`
+	// Optional TLS settings, TLS is enabled when tls_ca is set
+	TLS_CA          string `yaml:"tls_ca" json:"tls_ca" toml:"tls_ca"`
+	TLS_Cert        string `yaml:"tls_cert" json:"tls_cert" toml:"tls_cert"`
+	TLS_Key         string `yaml:"tls_key" json:"tls_key" toml:"tls_key"`
+	TLS_Skip_Verify bool   `yaml:"tls_skip_verify" json:"tls_skip_verify" toml:"tls_skip_verify"`
+	// Optional connection pool settings, zero keeps the database/sql defaults
+	Max_Open_Conns    int           `yaml:"max_open_conns" json:"max_open_conns" toml:"max_open_conns"`
+	Max_Idle_Conns    int           `yaml:"max_idle_conns" json:"max_idle_conns" toml:"max_idle_conns"`
+	Conn_Max_Lifetime time.Duration `yaml:"conn_max_lifetime" json:"conn_max_lifetime" toml:"conn_max_lifetime"`
+}
+
+// Struct for yaml config file
+type Config struct {
+	Exporter_Port int `yaml:"exporter_port" json:"exporter_port" toml:"exporter_port"`
+	// Optional type of the database: mysql (default), postgres, sqlite or mssql
+	DB_Type string `yaml:"db_type" json:"db_type" toml:"db_type"`
+	// Use Windows Authentication instead of db_user and db_password, only supported by mssql
+	DB_Integrated_Security bool   `yaml:"db_integrated_security" json:"db_integrated_security" toml:"db_integrated_security"`
+	DB_Host                string `yaml:"db_host" json:"db_host" toml:"db_host"`
+	DB_Port                int    `yaml:"db_port" json:"db_port" toml:"db_port"`
+	// Optional path of the Unix socket of a local MySQL server, used instead of db_host and db_port
+	DB_Socket string `yaml:"db_socket" json:"db_socket" toml:"db_socket"`
+	// Send a PROXY protocol v1 header when connecting, for MySQL behind ProxySQL or HAProxy
+	DB_Proxy_Protocol bool `yaml:"db_proxy_protocol" json:"db_proxy_protocol" toml:"db_proxy_protocol"`
+	// Optional flavor of the MySQL database: mysql (default) or mariadb
+	DB_Flavor string `yaml:"db_flavor" json:"db_flavor" toml:"db_flavor"`
+	// Optional character set (default utf8mb4), collation and time zone (default Local) of the MySQL connections
+	DB_Charset   string `yaml:"db_charset" json:"db_charset" toml:"db_charset"`
+	DB_Collation string `yaml:"db_collation" json:"db_collation" toml:"db_collation"`
+	DB_Loc       string `yaml:"db_loc" json:"db_loc" toml:"db_loc"`
+	DB_User      string `yaml:"db_user" json:"db_user" toml:"db_user"`
+	DB_Password  string `yaml:"db_password" json:"db_password" toml:"db_password"`
+	// Optional TLS settings of the MySQL connections. TLS is enabled when db_tls_ca is set.
+	DB_TLS_CA          string `yaml:"db_tls_ca" json:"db_tls_ca" toml:"db_tls_ca"`
+	DB_TLS_Cert        string `yaml:"db_tls_cert" json:"db_tls_cert" toml:"db_tls_cert"`
+	DB_TLS_Key         string `yaml:"db_tls_key" json:"db_tls_key" toml:"db_tls_key"`
+	DB_TLS_Skip_Verify bool   `yaml:"db_tls_skip_verify" json:"db_tls_skip_verify" toml:"db_tls_skip_verify"`
+	// Optional connection pool settings, zero keeps the database/sql defaults
+	DB_Max_Open_Conns    int           `yaml:"db_max_open_conns" json:"db_max_open_conns" toml:"db_max_open_conns"`
+	DB_Max_Idle_Conns    int           `yaml:"db_max_idle_conns" json:"db_max_idle_conns" toml:"db_max_idle_conns"`
+	DB_Conn_Max_Lifetime time.Duration `yaml:"db_conn_max_lifetime" json:"db_conn_max_lifetime" toml:"db_conn_max_lifetime"`
+	// Optional files to read the credentials from, e.g. Docker or Kubernetes secrets. They override the inline values.
+	DB_User_File     string `yaml:"db_user_file" json:"db_user_file" toml:"db_user_file"`
+	DB_Password_File string `yaml:"db_password_file" json:"db_password_file" toml:"db_password_file"`
+	// Alias of db_tls_key, which is already read from a file. Overrides db_tls_key when set.
+	DB_TLS_Key_File string `yaml:"db_tls_key_file" json:"db_tls_key_file" toml:"db_tls_key_file"`
+	// Optional list of additional databases queries can run on
+	Databases []DBConfig `yaml:"databases" json:"databases" toml:"databases"`
+	Queries   []Query    `yaml:"queries" json:"queries" toml:"queries"`
+	// Optional directory of YAML files with further queries, relative to the directory of the config file
+	Queries_Dir string `yaml:"queries_dir" json:"queries_dir" toml:"queries_dir"`
+	// Optional interval of the queries which don't set one
+	Default_Interval time.Duration `yaml:"default_interval" json:"default_interval" toml:"default_interval"`
+	// Optional delay between the first runs of consecutive queries: the Nth query first runs N * query_start_delay
+	// after the start, in addition to its jitter
+	Query_Start_Delay time.Duration `yaml:"query_start_delay" json:"query_start_delay" toml:"query_start_delay"`
+	// How metrics are exposed: pull (default) serves /metrics, push sends them to the Pushgateway after each query, both does both
+	Mode             string `yaml:"mode" json:"mode" toml:"mode"`
+	Push_Gateway_URL string `yaml:"push_gateway_url" json:"push_gateway_url" toml:"push_gateway_url"`
+	Push_Job_Name    string `yaml:"push_job_name" json:"push_job_name" toml:"push_job_name"`
+	// Optional OTLP/HTTP collector the query executions are traced to, as host:port or http(s):// URL
+	Otel_Endpoint string `yaml:"otel_endpoint" json:"otel_endpoint" toml:"otel_endpoint"`
+	// Optional timeout of the database pings done by /healthz. Defaults to 3s.
+	Healthcheck_Timeout time.Duration `yaml:"healthcheck_timeout" json:"healthcheck_timeout" toml:"healthcheck_timeout"`
+	// Optional maximum duration a scrape waits for the metrics to be gathered before it is served the metrics
+	// gathered last. Defaults to 5s.
+	Scrape_Timeout time.Duration `yaml:"scrape_timeout" json:"scrape_timeout" toml:"scrape_timeout"`
+	// Optional namespace and subsystem of the metrics shared by queries without a metric_name.
+	// Default to mysql_query and exporter, naming them mysql_query_exporter and mysql_query_exporter_column.
+	Metric_Namespace string `yaml:"metric_namespace" json:"metric_namespace" toml:"metric_namespace"`
+	Metric_Subsystem string `yaml:"metric_subsystem" json:"metric_subsystem" toml:"metric_subsystem"`
+	// Leave the query label with the SQL statement out of the query result metrics to reduce their cardinality
+	Disable_Query_Label bool `yaml:"disable_query_label" json:"disable_query_label" toml:"disable_query_label"`
+	// Add db_host and db_name labels with the database of every result to the query result metrics, defaults to true
+	Add_DB_Labels *bool `yaml:"add_db_labels" json:"add_db_labels" toml:"add_db_labels"`
+	// Prefix the SQL sent to the database with a comment naming the query and exporter, defaults to true
+	Add_Query_Comment *bool `yaml:"add_query_comment" json:"add_query_comment" toml:"add_query_comment"`
+	// Optional relabelling of the exposed metrics, with the syntax of Prometheus' metric_relabel_configs
+	Metric_Relabel_Configs []RelabelConfig `yaml:"metric_relabel_configs" json:"metric_relabel_configs" toml:"metric_relabel_configs"`
+	// Optional buckets of the query duration histogram, in seconds
+	Histogram_Buckets []float64 `yaml:"histogram_buckets" json:"histogram_buckets" toml:"histogram_buckets"`
+	// Optional basic authentication of /metrics, the password is stored as a bcrypt hash
+	Web_Auth_Username      string `yaml:"web_auth_username" json:"web_auth_username" toml:"web_auth_username"`
+	Web_Auth_Password_Hash string `yaml:"web_auth_password_hash" json:"web_auth_password_hash" toml:"web_auth_password_hash"`
+	// Format of the log output: text (default) or json, and the minimum level logged: debug, info (default), warn or error
+	Log_Format string `yaml:"log_format" json:"log_format" toml:"log_format"`
+	Log_Level  string `yaml:"log_level" json:"log_level" toml:"log_level"`
+	// Optional timeouts of the HTTP server. Default to 5s, 10s and 120s.
+	Web_Read_Timeout  time.Duration `yaml:"web_read_timeout" json:"web_read_timeout" toml:"web_read_timeout"`
+	Web_Write_Timeout time.Duration `yaml:"web_write_timeout" json:"web_write_timeout" toml:"web_write_timeout"`
+	Web_Idle_Timeout  time.Duration `yaml:"web_idle_timeout" json:"web_idle_timeout" toml:"web_idle_timeout"`
+	// Optional maximum duration of waiting for in-flight scrapes on shutdown. Defaults to 30s.
+	Shutdown_Timeout time.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout" toml:"shutdown_timeout"`
+	// Optional certificate and key to serve the HTTP endpoints over HTTPS, reloaded when the files change
+	Web_TLS_Cert_File string `yaml:"web_tls_cert_file" json:"web_tls_cert_file" toml:"web_tls_cert_file"`
+	Web_TLS_Key_File  string `yaml:"web_tls_key_file" json:"web_tls_key_file" toml:"web_tls_key_file"`
+	// Optional additional ports, each serving only the metrics of some queries on /metrics, e.g. one per team
+	Listen_Addresses []ListenAddress `yaml:"listen_addresses" json:"listen_addresses" toml:"listen_addresses"`
+	// Optional metrics computed from the results of several queries, such as an error rate
+	Derived_Metrics []DerivedMetric `yaml:"derived_metrics" json:"derived_metrics" toml:"derived_metrics"`
+
+	// Number of disabled queries left out of Queries by loadConfig, reported in mysql_query_exporter_queries_disabled_total
+	disabledQueries int
+}
+
+// configOverrides holds the command line flags which take precedence over fields of the config.
+// Zero values leave the fields of the config unchanged.
+type configOverrides struct {
+	port       int
+	dbHost     string
+	dbPort     int
+	dbUser     string
+	dbPassword string
+}
+
+// apply sets the fields of config overridden on the command line.
+func (o configOverrides) apply(config *Config) {
+	if o.port != 0 {
+		config.Exporter_Port = o.port
+	}
+	if o.dbHost != "" {
+		config.DB_Host = o.dbHost
+	}
+	if o.dbPort != 0 {
+		config.DB_Port = o.dbPort
+	}
+	if o.dbUser != "" {
+		config.DB_User = o.dbUser
+	}
+	if o.dbPassword != "" {
+		config.DB_Password = o.dbPassword
+	}
+}
+
+// defaultConfigPath returns the location of the config used when -config is not set:
+// MQCE_CONFIG when it is set, query_config.yaml otherwise.
+func defaultConfigPath() string {
+	if path := os.Getenv(envDefaultPrefix + "CONFIG"); path != "" {
+		return path
+	}
+	return "query_config.yaml"
+}
+
+// applyEnvDefaults sets the fields of config left empty by the config file from the MQCE_ environment
+// variables, named after the config keys in upper case, e.g. MQCE_DB_HOST for db_host.
+func applyEnvDefaults(config *Config) error {
+	stringFields := []struct {
+		key   string
+		value *string
+	}{
+		{"db_host", &config.DB_Host},
+		{"db_user", &config.DB_User},
+		{"db_password", &config.DB_Password},
+	}
+	for _, field := range stringFields {
+		if env, ok := os.LookupEnv(envDefaultPrefix + strings.ToUpper(field.key)); ok && *field.value == "" {
+			*field.value = env
+		}
+	}
+
+	intFields := []struct {
+		key   string
+		value *int
+	}{
+		{"db_port", &config.DB_Port},
+		{"exporter_port", &config.Exporter_Port},
+	}
+	for _, field := range intFields {
+		name := envDefaultPrefix + strings.ToUpper(field.key)
+		env, ok := os.LookupEnv(name)
+		if !ok || *field.value != 0 {
+			continue
+		}
+		value, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: must be an integer", name, env)
+		}
+		*field.value = value
+	}
+
+	return nil
+}
+
+// readConfig reads the config file filename in the given format.
+// When format is empty it is detected from the file extension, defaulting to YAML.
+func readConfig(filename string, format string) (Config, error) {
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if format == "" {
+		format = configFormatFromExtension(filename)
+	}
+
+	return decodeConfig(bytes, format)
+}
+
+// loadConfig reads the config from location, which is either a file path or an http:// or https:// URL.
+// authToken is sent as bearer token when fetching the config from a URL.
+func loadConfig(location string, format string, authToken string) (Config, error) {
+	var config Config
+	var err error
+
+	// Relative queries_dir paths are relative to the directory of a config file, or to the working directory
+	baseDir := "."
+	if isConfigURL(location) {
+		config, err = fetchConfig(location, format, authToken)
+	} else {
+		config, err = readConfig(location, format)
+		baseDir = filepath.Dir(location)
+	}
+	if err != nil {
+		return Config{}, err
+	}
+
+	// The MQCE_ environment variables fill in what the config leaves empty
+	if err := applyEnvDefaults(&config); err != nil {
+		return Config{}, err
+	}
+
+	if config.Queries_Dir != "" {
+		dir := config.Queries_Dir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(baseDir, dir)
+		}
+		if err := readQueriesDir(&config, dir); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// Disabled queries are left out as if they weren't configured, so they are neither run nor exported
+	queries := config.Queries[:0]
+	for _, conf := range config.Queries {
+		if conf.Disabled {
+			config.disabledQueries++
+			continue
+		}
+
+		// Queries without an interval run every default_interval
+		if conf.Interval == 0 {
+			conf.Interval = config.Default_Interval
+		}
+
+		// Render the queries with template_vars into the SQL that is run
+		if err := renderQueryTemplate(&conf); err != nil {
+			return Config{}, err
+		}
+		queries = append(queries, conf)
+	}
+	config.Queries = queries
+
+	return config, nil
+}
+
+// Struct for the query files in queries_dir
+type queriesFile struct {
+	Queries []Query `yaml:"queries"`
+}
+
+// readQueriesDir appends the queries of every *.yaml and *.yml file in dir to the queries of config,
+// in the order of the file names. A query name defined more than once across the files and
+// config is an error.
+func readQueriesDir(config *Config, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading queries_dir: %w", err)
+	}
+
+	// Remember where every query was defined to report duplicates
+	defined := make(map[string]string)
+	for _, conf := range config.Queries {
+		defined[conf.Name] = "the config file"
+	}
+
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var file queriesFile
+		if err := yaml.Unmarshal(bytes, &file); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, annotateYAMLError(err, bytes, true))
+		}
+
+		// Replace ${VAR} references like in the config file
+		if err := expandEnv(reflect.ValueOf(&file).Elem(), path); err != nil {
+			return err
+		}
+
+		for _, conf := range file.Queries {
+			if where, ok := defined[conf.Name]; ok && conf.Name != "" {
+				return fmt.Errorf("query %s in %s is already defined in %s", conf.Name, path, where)
+			}
+			defined[conf.Name] = path
+		}
+		config.Queries = append(config.Queries, file.Queries...)
+	}
+
+	return nil
+}
+
+// decodeConfig parses a config in the given format, expands environment variables and reads the secret files.
+func decodeConfig(bytes []byte, format string) (Config, error) {
+	config, err := parseConfig(bytes, format)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	// Replace ${VAR} references with the values of environment variables
+	if err := expandEnv(reflect.ValueOf(&config).Elem(), ""); err != nil {
+		return Config{}, err
+	}
+
+	// Read the credentials stored in separate files
+	if err := readSecretFiles(&config); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+// renderQueryTemplate replaces the query and statements of conf with the result of executing them as a
+// text/template with the template_vars as data. Queries without template_vars are left unchanged.
+// Referencing a variable missing from template_vars is an error.
+func renderQueryTemplate(conf *Query) error {
+	if len(conf.Template_Vars) == 0 {
+		return nil
+	}
+
+	if len(conf.Statements) > 0 {
+		// Copy the statements before changing them, they are shared with the unrendered config
+		statements := make([]string, len(conf.Statements))
+		for i, statement := range conf.Statements {
+			rendered, err := renderTemplate(*conf, statement)
+			if err != nil {
+				return err
+			}
+			statements[i] = rendered
+		}
+		conf.Statements = statements
+		return nil
+	}
+
+	rendered, err := renderTemplate(*conf, conf.Query)
+	if err != nil {
+		return err
+	}
+	conf.Query = rendered
+	return nil
+}
+
+// renderTemplate executes text, the query or a statement of conf, as a text/template with the template_vars of conf as data.
+func renderTemplate(conf Query, text string) (string, error) {
+	tmpl, err := template.New(conf.Name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing query template of query %s: %w", conf.Name, err)
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, conf.Template_Vars); err != nil {
+		return "", fmt.Errorf("error rendering query template of query %s: %w", conf.Name, err)
+	}
+	if strings.TrimSpace(rendered.String()) == "" {
+		return "", fmt.Errorf("query %s is empty after rendering its template_vars", conf.Name)
+	}
+	return rendered.String(), nil
+}
+
+// configFormatFromExtension returns the config format matching the extension of filename, defaulting to YAML.
+func configFormatFromExtension(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return configFormatJSON
+	case ".toml":
+		return configFormatTOML
+	default:
+		return configFormatYAML
+	}
+}
+
+// parseConfig unmarshals a config in the given format.
+func parseConfig(bytes []byte, format string) (Config, error) {
+	var config Config
+
+	switch format {
+	case configFormatYAML:
+		if err := yaml.Unmarshal(bytes, &config); err != nil {
+			return Config{}, annotateYAMLError(err, bytes, true)
+		}
+	case configFormatTOML:
+		if err := toml.Unmarshal(bytes, &config); err != nil {
+			return Config{}, err
+		}
+	case configFormatJSON:
+		// encoding/json can't read durations such as "30s", so the JSON document is
+		// checked and decoded with encoding/json and then mapped onto Config through YAML.
+		var document interface{}
+		if err := json.Unmarshal(bytes, &document); err != nil {
+			return Config{}, err
+		}
+		converted, err := yaml.Marshal(document)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := yaml.Unmarshal(converted, &config); err != nil {
+			// The line numbers are those of the converted document, so only the fields are reported
+			return Config{}, annotateYAMLError(err, converted, false)
+		}
+	default:
+		return Config{}, fmt.Errorf("unknown config format %s, must be one of %s, %s or %s", format, configFormatYAML, configFormatJSON, configFormatTOML)
+	}
+
+	return config, nil
+}
+
+// annotateYAMLError names the field of every value of document which couldn't be unmarshalled into the config,
+// e.g. "line 3: cannot unmarshal !!str `5x` into time.Duration (field interval)", as the YAML decoder only reports
+// the line. The line numbers are left out unless withLines is set. Other errors are returned unchanged.
+func annotateYAMLError(err error, document []byte, withLines bool) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+
+	lines := strings.Split(string(document), "\n")
+	messages := make([]string, len(typeErr.Errors))
+	for i, message := range typeErr.Errors {
+		messages[i] = message
+		match := yamlErrorLinePattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		if !withLines {
+			messages[i] = strings.TrimPrefix(message, match[0])
+		}
+
+		// The field is the key of the line, which may be the first key of a list item
+		n, _ := strconv.Atoi(match[1])
+		if n < 1 || n > len(lines) {
+			continue
+		}
+		key, _, found := strings.Cut(strings.TrimLeft(lines[n-1], " \t-"), ":")
+		if key = strings.Trim(strings.TrimSpace(key), `"'`); found && key != "" {
+			messages[i] = fmt.Sprintf("%s (field %s)", messages[i], key)
+		}
+	}
+	return &yaml.TypeError{Errors: messages}
+}
+
+// expandEnv replaces ${VAR} references in every string reachable from v with the value of the environment variable VAR.
+// It returns an error naming the config field if a referenced variable is not set. path is the yaml path of v.
+func expandEnv(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.String:
+		var missing []string
+		expanded := envReferencePattern.ReplaceAllStringFunc(v.String(), func(reference string) string {
+			name := envReferencePattern.FindStringSubmatch(reference)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("%s references unset environment variable %s", path, strings.Join(missing, ", "))
+		}
+		v.SetString(expanded)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			// Name fields by their yaml key so errors match the config file
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := expandEnv(v.Field(i), name); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Only maps of strings, such as extra_labels, can hold references
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			if err := expandEnv(value, fmt.Sprintf("%s.%s", path, key)); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandEnv(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readSecretFiles replaces the credentials of config with the contents of their _file variants, if set.
+// Trailing newlines are trimmed from the file contents.
+func readSecretFiles(config *Config) error {
+	secrets := []struct {
+		name  string
+		file  string
+		value *string
+	}{
+		{"db_user_file", config.DB_User_File, &config.DB_User},
+		{"db_password_file", config.DB_Password_File, &config.DB_Password},
+	}
+
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+		bytes, err := os.ReadFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", secret.name, err)
+		}
+		*secret.value = strings.TrimRight(string(bytes), "\r\n")
+	}
+
+	// The TLS key is read from its file when the TLS configuration is built
+	if config.DB_TLS_Key_File != "" {
+		config.DB_TLS_Key = config.DB_TLS_Key_File
+	}
+
+	return nil
+}
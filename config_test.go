@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes contents to a new file in a temporary directory, named after pattern as by os.CreateTemp,
+// and returns its path.
+func writeTestConfig(t testing.TB, pattern string, contents string) string {
+	t.Helper()
+	file, err := os.CreateTemp(t.TempDir(), pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// Valid config with several queries, shared by the config tests and benchmarks
+const testConfig = `
+exporter_port: 2112
+db_host: db.example.com
+db_port: 3306
+db_user: exporter
+db_password: secret
+queries:
+  - name: users
+    query: SELECT COUNT(*) FROM users
+    interval: 30s
+  - name: orders
+    query: SELECT COUNT(*) FROM orders WHERE status = 'pending'
+    interval: 1m
+    extra_labels:
+      team: shop
+  - name: signups
+    query: SELECT COUNT(*) FROM users WHERE created_at > NOW() - INTERVAL 1 DAY
+    interval: 1h
+    database: app
+`
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		contents string
+		// Names of the queries read, when the config is valid
+		queries []string
+		// Parts of the error message, empty if the config is valid
+		errors []string
+	}{
+		{name: "valid", pattern: "*.yaml", contents: testConfig, queries: []string{"users", "orders", "signups"}},
+		{name: "JSON", pattern: "*.json", contents: `{"queries": [{"name": "users", "query": "SELECT 1", "interval": "30s"}]}`, queries: []string{"users"}},
+		{name: "TOML", pattern: "*.toml", contents: "[[queries]]\nname = \"users\"\nquery = \"SELECT 1\"\ninterval = \"30s\"\n", queries: []string{"users"}},
+		{name: "empty file", pattern: "*.yaml", contents: ""},
+		{name: "no queries", pattern: "*.yaml", contents: "exporter_port: 2112\nqueries: []\n"},
+		{name: "YAML syntax error", pattern: "*.yaml", contents: "queries:\n  - name: users\n    query: [SELECT 1\n", errors: []string{"yaml: line 3", "did not find expected"}},
+		{name: "invalid interval", pattern: "*.yaml", contents: "queries:\n  - name: users\n    interval: 5x\n", errors: []string{"line 3", "`5x` into time.Duration", "(field interval)"}},
+		{name: "invalid port", pattern: "*.yaml", contents: "exporter_port: http\n", errors: []string{"line 1", "`http` into int", "(field exporter_port)"}},
+		{name: "invalid JSON interval", pattern: "*.json", contents: `{"queries": [{"name": "users", "interval": "5x"}]}`, errors: []string{"(field interval)"}},
+		{name: "invalid TOML interval", pattern: "*.toml", contents: "[[queries]]\nname = \"users\"\ninterval = \"5x\"\n", errors: []string{"queries.interval", "invalid duration"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := readConfig(writeTestConfig(t, test.pattern, test.contents), "")
+			if len(test.errors) > 0 {
+				if err == nil {
+					t.Fatalf("got no error, want %q", test.errors)
+				}
+				for _, want := range test.errors {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("got error %q, want it to contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, conf := range config.Queries {
+				names = append(names, conf.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(test.queries, ",") {
+				t.Errorf("got queries %v, want %v", names, test.queries)
+			}
+		})
+	}
+}
+
+func TestReadConfigMissingFile(t *testing.T) {
+	_, err := readConfig(filepath.Join(t.TempDir(), "missing.yaml"), "")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v, want a missing file error", err)
+	}
+}
+
+func TestReadConfigFields(t *testing.T) {
+	config, err := readConfig(writeTestConfig(t, "*.yaml", testConfig), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Exporter_Port != 2112 || config.DB_Host != "db.example.com" || config.DB_Port != 3306 || config.DB_User != "exporter" {
+		t.Errorf("got exporter_port %d, db_host %q, db_port %d and db_user %q", config.Exporter_Port, config.DB_Host, config.DB_Port, config.DB_User)
+	}
+	orders := config.Queries[1]
+	if orders.Interval != time.Minute || orders.Extra_Labels["team"] != "shop" {
+		t.Errorf("got interval %s and extra_labels %v", orders.Interval, orders.Extra_Labels)
+	}
+	if signups := config.Queries[2]; signups.Database != "app" || signups.Interval != time.Hour {
+		t.Errorf("got database %q and interval %s", signups.Database, signups.Interval)
+	}
+}
+
+func TestLoadConfigEnvExpansion(t *testing.T) {
+	t.Setenv("TEST_DB_PASSWORD", "from-env")
+	t.Setenv("TEST_TEAM", "billing")
+
+	path := writeTestConfig(t, "*.yaml", `
+db_password: ${TEST_DB_PASSWORD}
+queries:
+  - name: invoices
+    query: SELECT 1
+    interval: 1m
+    extra_labels:
+      team: ${TEST_TEAM}
+`)
+	config, err := loadConfig(path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DB_Password != "from-env" {
+		t.Errorf("db_password = %q, want from-env", config.DB_Password)
+	}
+	if team := config.Queries[0].Extra_Labels["team"]; team != "billing" {
+		t.Errorf("extra label team = %q, want billing", team)
+	}
+
+	// Unset variables are an error naming the field
+	path = writeTestConfig(t, "*.yaml", "db_user: ${TEST_UNSET_VARIABLE}\n")
+	_, err = loadConfig(path, "", "")
+	if err == nil || !strings.Contains(err.Error(), "db_user references unset environment variable TEST_UNSET_VARIABLE") {
+		t.Errorf("got error %v, want the unset variable of db_user", err)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	t.Setenv(envDefaultPrefix+"DB_HOST", "env.example.com")
+	t.Setenv(envDefaultPrefix+"DB_USER", "env-user")
+
+	path := writeTestConfig(t, "*.yaml", `
+db_user: file-user
+default_interval: 2m
+queries:
+  - name: default_interval
+    query: SELECT 1
+  - name: own_interval
+    query: SELECT 1
+    interval: 10s
+  - name: disabled
+    query: SELECT 1
+    disabled: true
+`)
+	config, err := loadConfig(path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The environment fills in what the file leaves empty
+	if config.DB_Host != "env.example.com" || config.DB_User != "file-user" {
+		t.Errorf("got db_host %q and db_user %q, want env.example.com and file-user", config.DB_Host, config.DB_User)
+	}
+	if len(config.Queries) != 2 || config.disabledQueries != 1 {
+		t.Fatalf("got %d queries and %d disabled, want 2 and 1", len(config.Queries), config.disabledQueries)
+	}
+	if got := config.Queries[0].Interval; got != 2*time.Minute {
+		t.Errorf("interval without interval = %s, want the default_interval 2m", got)
+	}
+	if got := config.Queries[1].Interval; got != 10*time.Second {
+		t.Errorf("interval = %s, want 10s", got)
+	}
+
+	t.Setenv(envDefaultPrefix+"EXPORTER_PORT", "not-a-port")
+	if _, err := loadConfig(path, "", ""); err == nil || !strings.Contains(err.Error(), "MQCE_EXPORTER_PORT") {
+		t.Errorf("got error %v, want the invalid MQCE_EXPORTER_PORT", err)
+	}
+}
+
+func TestLoadConfigIntervalIsDuration(t *testing.T) {
+	path := writeTestConfig(t, "*.yaml", `
+queries:
+  - name: five_seconds
+    query: SELECT 1
+    interval: 5s
+`)
+
+	config, err := loadConfig(path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Queries[0].Interval; got != 5*time.Second {
+		t.Errorf("interval = %s, want 5s", got)
+	}
+}
+
+func TestQueryStructFieldName(t *testing.T) {
+	queryType := reflect.TypeOf(Query{})
+	if _, ok := queryType.FieldByName("Databse"); ok {
+		t.Error("Query has the misspelled field Databse")
+	}
+	field, ok := queryType.FieldByName("Database")
+	if !ok {
+		t.Fatal("Query has no Database field")
+	}
+	if tag := field.Tag.Get("yaml"); tag != "database" {
+		t.Errorf("Database is read from %q, want database", tag)
+	}
+
+	// Existing configs keep setting the database of a query
+	config, err := parseConfig([]byte("queries:\n  - name: orders\n    database: shop\n"), configFormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Queries[0].Database; got != "shop" {
+		t.Errorf("database = %q, want shop", got)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Value shown instead of secrets on /config
+const redacted = "***"
+
+// currentConfig holds the config the exporter is running with, replaced on every successful reload.
+type currentConfig struct {
+	mu     sync.RWMutex
+	config Config
+}
+
+// Config the exporter is running with, reported by /config
+var runningConfig = &currentConfig{}
+
+// set replaces the running config.
+func (c *currentConfig) set(config Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.config = config
+}
+
+// get returns the running config.
+func (c *currentConfig) get() Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.config
+}
+
+// redactConfig returns a copy of config with its passwords, TLS keys and webhook secrets replaced by ***.
+func redactConfig(config Config) Config {
+	redact := func(value *string) {
+		if *value != "" {
+			*value = redacted
+		}
+	}
+
+	redact(&config.DB_Password)
+	redact(&config.DB_TLS_Key)
+	redact(&config.DB_TLS_Key_File)
+	redact(&config.Web_Auth_Password_Hash)
+	redact(&config.Web_TLS_Key_File)
+	config.Push_Gateway_URL = redactURL(config.Push_Gateway_URL)
+
+	// Copy the lists before changing them, they are shared with the running config
+	config.Databases = append([]DBConfig(nil), config.Databases...)
+	for i := range config.Databases {
+		redact(&config.Databases[i].Password)
+		redact(&config.Databases[i].TLS_Key)
+	}
+
+	config.Queries = append([]Query(nil), config.Queries...)
+	for i := range config.Queries {
+		redact(&config.Queries[i].Password)
+		alerts := append([]AlertConfig(nil), config.Queries[i].Alerts...)
+		for j := range alerts {
+			// Slack webhook URLs authorize posting on their own
+			redact(&alerts[j].Slack_Webhook_URL)
+			alerts[j].Notification_URL = redactURL(alerts[j].Notification_URL)
+		}
+		config.Queries[i].Alerts = alerts
+	}
+
+	return config
+}
+
+// redactURL replaces the password of a URL with ***. Values which are not URLs are returned unchanged.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	// url.Redacted writes the password as xxxxx, which is shown as *** like the other secrets
+	return strings.Replace(u.Redacted(), ":xxxxx@", ":"+redacted+"@", 1)
+}
+
+// configDocument converts a config value into maps, slices and scalars keyed by their json names,
+// with durations written like in the config file, e.g. 30s instead of nanoseconds.
+func configDocument(v reflect.Value) any {
+	if duration, ok := v.Interface().(time.Duration); ok {
+		return duration.String()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		document := make(map[string]any, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			document[name] = configDocument(v.Field(i))
+		}
+		return document
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		document := make([]any, v.Len())
+		for i := range document {
+			document[i] = configDocument(v.Index(i))
+		}
+		return document
+	default:
+		return v.Interface()
+	}
+}
+
+// configHandler returns a handler that responds with the config returned by config as JSON, with its secrets redacted.
+func configHandler(config func() Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		document := configDocument(reflect.ValueOf(redactConfig(config())))
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(document); err != nil {
+			slog.Error("Error writing /config response", "error", err)
+		}
+	}
+}
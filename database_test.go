@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// testCerts are the paths of a CA and of a server and client certificate signed by it.
+type testCerts struct {
+	CA, ServerCert, ServerKey, ClientCert, ClientKey string
+}
+
+// generateTestCerts writes a CA and a server and client certificate signed by it to dir.
+// The server certificate is valid for localhost and 127.0.0.1.
+func generateTestCerts(t testing.TB, dir string) testCerts {
+	t.Helper()
+	certs := testCerts{
+		CA:         filepath.Join(dir, "ca.pem"),
+		ServerCert: filepath.Join(dir, "server-cert.pem"),
+		ServerKey:  filepath.Join(dir, "server-key.pem"),
+		ClientCert: filepath.Join(dir, "client-cert.pem"),
+		ClientKey:  filepath.Join(dir, "client-key.pem"),
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mysql_count_query_exporter test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPEM(t, certs.CA, "CERTIFICATE", caDER)
+
+	leaves := []struct {
+		cert, key string
+		template  *x509.Certificate
+	}{
+		{certs.ServerCert, certs.ServerKey, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}},
+		{certs.ClientCert, certs.ClientKey, &x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: "exporter"},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}},
+	}
+	for _, leaf := range leaves {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf.template.NotBefore = caTemplate.NotBefore
+		leaf.template.NotAfter = caTemplate.NotAfter
+		leaf.template.KeyUsage = x509.KeyUsageDigitalSignature
+		der, err := x509.CreateCertificate(rand.Reader, leaf.template, caTemplate, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestPEM(t, leaf.cert, "CERTIFICATE", der)
+		writeTestPEM(t, leaf.key, "PRIVATE KEY", keyDER)
+	}
+
+	return certs
+}
+
+// writeTestPEM writes der as a PEM block of the given type to path.
+func writeTestPEM(t testing.TB, path string, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterTLSConfig(t *testing.T) {
+	certs := generateTestCerts(t, t.TempDir())
+	db := DBConfig{
+		Name:     "tls_test",
+		Host:     "127.0.0.1",
+		Port:     3306,
+		TLS_CA:   certs.CA,
+		TLS_Cert: certs.ClientCert,
+		TLS_Key:  certs.ClientKey,
+	}
+
+	if err := registerTLSConfig(db.Name, db); err != nil {
+		t.Fatal(err)
+	}
+	dsn := mysqlDSN(db.Name, db)
+	if want := "tls=" + tlsConfigFor(db.Name); !strings.Contains(dsn, want) {
+		t.Errorf("DSN %s doesn't contain %s", dsn, want)
+	}
+
+	// The driver resolves the name in the DSN to the registered configuration
+	parsed, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.TLS == nil {
+		t.Fatal("TLS configuration of the DSN is not registered")
+	}
+	if len(parsed.TLS.Certificates) != 1 {
+		t.Errorf("got %d client certificates, want 1", len(parsed.TLS.Certificates))
+	}
+	if parsed.TLS.InsecureSkipVerify {
+		t.Error("server certificate is not verified")
+	}
+}
+
+func TestRegisterTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	certs := generateTestCerts(t, dir)
+	notPEM := filepath.Join(dir, "not-pem.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		db   DBConfig
+		want string
+	}{
+		{"missing CA", DBConfig{TLS_CA: filepath.Join(dir, "missing.pem")}, "error reading TLS CA"},
+		{"CA without certificates", DBConfig{TLS_CA: notPEM}, "no PEM certificates found"},
+		{"certificate without key", DBConfig{TLS_CA: certs.CA, TLS_Cert: certs.ClientCert}, "error loading TLS certificate and key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := registerTLSConfig("tls_errors", test.db)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestMySQLDSNSkipVerify(t *testing.T) {
+	dsn := mysqlDSN("", DBConfig{Host: "127.0.0.1", Port: 3306, TLS_Skip_Verify: true})
+	if !strings.Contains(dsn, "tls=skip-verify") {
+		t.Errorf("DSN %s doesn't skip verification", dsn)
+	}
+}
+
+func TestSanitizeDSNError(t *testing.T) {
+	mysqlDB := DBConfig{Host: "db.example.com", Port: 3306, User: "exporter", Password: "s3cr3t:p@ss/word", Database: "app"}
+	dsn := mysqlDSN("", mysqlDB)
+	postgresDSN := postgresDSN(DBConfig{Host: "pg.example.com", Port: 5432, User: "exporter", Password: "s3cr3t", Database: "app"})
+
+	tests := []struct {
+		name string
+		dsn  string
+		err  error
+		want string
+	}{
+		{
+			"DSN in message",
+			dsn,
+			errors.New("invalid DSN " + dsn),
+			"invalid DSN exporter:***@tcp(db.example.com:3306)/app?loc=Local&charset=utf8mb4",
+		},
+		{
+			"password in driver error",
+			dsn,
+			errors.New("connection refused while authenticating with password s3cr3t:p@ss/word"),
+			"connection refused while authenticating with password ***",
+		},
+		{
+			"MySQL access denied",
+			dsn,
+			errors.New("Error 1045 (28000): Access denied for user 'exporter'@'db.example.com' (using password: YES)"),
+			"Error 1045 (28000): Access denied for user '***'@'db.example.com' (using password: YES)",
+		},
+		{
+			"user@host",
+			dsn,
+			errors.New("dial exporter@db.example.com failed"),
+			"dial ***@db.example.com failed",
+		},
+		{
+			"PostgreSQL URL",
+			postgresDSN,
+			errors.New(`pq: password authentication failed for user "exporter" with password s3cr3t`),
+			`pq: password authentication failed for user "exporter" with password ***`,
+		},
+		{
+			"no credentials in message",
+			dsn,
+			errors.New("driver: bad connection"),
+			"driver: bad connection",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := sanitizeDSNError(test.err, test.dsn)
+			if got.Error() != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if strings.Contains(got.Error(), "s3cr3t") {
+				t.Errorf("%q contains the password", got)
+			}
+		})
+	}
+
+	if err := sanitizeDSNError(nil, dsn); err != nil {
+		t.Errorf("got %v for a nil error", err)
+	}
+}
+
+func TestQueryDBKeyCredentials(t *testing.T) {
+	config := Config{DB_Host: "db.example.com", DB_Port: 3306, DB_User: "exporter", DB_Password: "shared"}
+	shared := queryDBKey(config, Query{Name: "shared"})
+
+	tests := []struct {
+		name string
+		conf Query
+		same bool
+	}{
+		{"default credentials", Query{Name: "other"}, true},
+		{"same user and password", Query{Name: "same", User: "exporter", Password: "shared"}, true},
+		{"same user, other password", Query{Name: "password", User: "exporter", Password: "other"}, false},
+		{"other user", Query{Name: "billing", User: "billing", Password: "shared"}, false},
+		{"other database", Query{Name: "database", Database: "billing"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := queryDBKey(config, test.conf) == shared; same != test.same {
+				t.Errorf("shares the connection pool: %t, want %t", same, test.same)
+			}
+		})
+	}
+
+	if strings.Contains(fmt.Sprintf("%#v", shared), "shared") {
+		t.Errorf("key %#v contains the password", shared)
+	}
+}
+
+// startAccessDeniedServer starts a fake MySQL server answering every connection with the access denied error for
+// user, as a server does for clients it refuses, and returns its host and port.
+func startAccessDeniedServer(t *testing.T, user string) (string, int) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	// An ERR packet with error code 1045 and SQLSTATE 28000, sent instead of the handshake
+	payload := append([]byte{0xff, 0x15, 0x04, '#'}, "28000Access denied for user '"+user+"'@'127.0.0.1' (using password: YES)"...)
+	packet := append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), 0}, payload...)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(packet)
+			conn.Close()
+		}
+	}()
+	return "127.0.0.1", listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestConnectionErrorsAreSanitized(t *testing.T) {
+	const user, password = "exporter", "s3cret-password"
+	host, port := startAccessDeniedServer(t, user)
+	dbConfig := DBConfig{Host: host, Port: port, User: user, Password: password, Database: "app"}
+	db, err := openDatabase("", dbConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := dbKey{Host: host, Port: port, Database: "app", User: user}
+	t.Cleanup(func() { closeDatabase(key, db) })
+
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	// The ping and the query of a run fail with the error of the server
+	conf := Query{Name: "sanitized_errors", Query: "SELECT 1", Database: "app", Interval: time.Hour}
+	queryStatuses.track(conf, key.String(), time.Time{})
+	t.Cleanup(func() { queryStatuses.forget(conf.Name) })
+	checkQuery(context.Background(), db, key, conf)
+	var lastError string
+	for _, state := range queryStatuses.snapshot() {
+		if state.Name == conf.Name {
+			lastError = state.LastError
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	healthHandler(func() map[dbKey]*sql.DB { return map[dbKey]*sql.DB{key: db} }, time.Second)(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+	for name, output := range map[string]string{"log": logs.String(), "status page": lastError, "/healthz": recorder.Body.String()} {
+		if !strings.Contains(output, "'***'@'127.0.0.1'") {
+			t.Errorf("%s doesn't report the sanitized access denied error: %s", name, output)
+		}
+		if strings.Contains(output, "'"+user+"'@") || strings.Contains(output, password) {
+			t.Errorf("%s contains the credentials: %s", name, output)
+		}
+	}
+}
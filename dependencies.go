@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dependencyOrder returns queries sorted so that every query comes after the queries named in its depends_on,
+// keeping the configured order otherwise. Circular dependencies are an error naming the queries in the cycle.
+// Dependencies on queries which aren't in queries are ignored, they are reported by validateConfig.
+func dependencyOrder(queries []Query) ([]Query, error) {
+	byName := make(map[string]Query, len(queries))
+	for _, conf := range queries {
+		byName[conf.Name] = conf
+	}
+
+	// Queries are visited depth first, a query met again while it is being visited closes a cycle
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(queries))
+	ordered := make([]Query, 0, len(queries))
+	var path []string
+
+	var visit func(conf Query) error
+	visit = func(conf Query) error {
+		switch state[conf.Name] {
+		case visited:
+			return nil
+		case visiting:
+			// The cycle starts where the query was first visited
+			start := 0
+			for i, name := range path {
+				if name == conf.Name {
+					start = i
+				}
+			}
+			cycle := append(append([]string(nil), path[start:]...), conf.Name)
+			return fmt.Errorf("circular depends_on: %s", strings.Join(cycle, " -> "))
+		}
+
+		state[conf.Name] = visiting
+		path = append(path, conf.Name)
+		for _, name := range conf.Depends_On {
+			dependency, ok := byName[name]
+			if !ok {
+				continue
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[conf.Name] = visited
+
+		ordered = append(ordered, conf)
+		return nil
+	}
+
+	for _, conf := range queries {
+		if err := visit(conf); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Struct for entries of the derived_metrics list in yaml file
+type DerivedMetric struct {
+	// Name of the exported metric
+	Name string `yaml:"name" json:"name" toml:"name"`
+	// Arithmetic on the results of queries referenced by name, such as "errors / total_requests * 100"
+	Expression  string `yaml:"expression" json:"expression" toml:"expression"`
+	Metric_Help string `yaml:"metric_help" json:"metric_help" toml:"metric_help"`
+}
+
+// derivedExpr is a parsed expression of a derived metric.
+type derivedExpr interface {
+	// eval returns the value of the expression, or false when a query it references has no result yet
+	eval(results map[string]float64) (float64, bool)
+}
+
+// Nodes of a parsed expression: numbers, query results and the four basic arithmetic operations
+type (
+	derivedNumber float64
+	derivedQuery  string
+	derivedBinary struct {
+		operator    byte
+		left, right derivedExpr
+	}
+)
+
+func (n derivedNumber) eval(map[string]float64) (float64, bool) {
+	return float64(n), true
+}
+
+func (q derivedQuery) eval(results map[string]float64) (float64, bool) {
+	value, ok := results[string(q)]
+	return value, ok
+}
+
+func (b derivedBinary) eval(results map[string]float64) (float64, bool) {
+	left, ok := b.left.eval(results)
+	if !ok {
+		return 0, false
+	}
+	right, ok := b.right.eval(results)
+	if !ok {
+		return 0, false
+	}
+
+	// Division by zero follows IEEE 754 like PromQL, resulting in +Inf, -Inf or NaN
+	switch b.operator {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	default:
+		return left / right, true
+	}
+}
+
+// derivedParser is a recursive descent parser of derived metric expressions, where * and / bind tighter than + and -.
+type derivedParser struct {
+	expression string
+	pos        int
+	queries    []string
+}
+
+// parseDerivedExpression parses an expression made of query names, numbers, parentheses and the operators
+// +, -, * and /. It returns the parsed expression and the names of the queries it references.
+func parseDerivedExpression(expression string) (derivedExpr, []string, error) {
+	p := &derivedParser{expression: expression}
+	expr, err := p.parseSum()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.expression) {
+		return nil, nil, fmt.Errorf("unexpected %q at offset %d of expression %q", p.expression[p.pos], p.pos, expression)
+	}
+	return expr, p.queries, nil
+}
+
+// parseSum parses terms joined by + and -.
+func (p *derivedParser) parseSum() (derivedExpr, error) {
+	return p.parseBinary("+-", p.parseProduct)
+}
+
+// parseProduct parses factors joined by * and /.
+func (p *derivedParser) parseProduct() (derivedExpr, error) {
+	return p.parseBinary("*/", p.parseFactor)
+}
+
+// parseBinary parses operands returned by operand joined by any of operators, from left to right.
+func (p *derivedParser) parseBinary(operators string, operand func() (derivedExpr, error)) (derivedExpr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.expression) || !strings.ContainsRune(operators, rune(p.expression[p.pos])) {
+			return left, nil
+		}
+		operator := p.expression[p.pos]
+		p.pos++
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = derivedBinary{operator: operator, left: left, right: right}
+	}
+}
+
+// parseFactor parses a number, a query name, a negated factor or an expression in parentheses.
+func (p *derivedParser) parseFactor() (derivedExpr, error) {
+	p.skipSpace()
+	if p.pos >= len(p.expression) {
+		return nil, fmt.Errorf("unexpected end of expression %q", p.expression)
+	}
+
+	c := p.expression[p.pos]
+	start := p.pos
+	switch {
+	case c == '(':
+		p.pos++
+		expr, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.expression) || p.expression[p.pos] != ')' {
+			return nil, fmt.Errorf("unclosed parenthesis at offset %d of expression %q", start, p.expression)
+		}
+		p.pos++
+		return expr, nil
+	case c == '-':
+		p.pos++
+		expr, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return derivedBinary{operator: '-', left: derivedNumber(0), right: expr}, nil
+	case c == '.' || c >= '0' && c <= '9':
+		for p.pos < len(p.expression) && (p.expression[p.pos] == '.' || p.expression[p.pos] >= '0' && p.expression[p.pos] <= '9') {
+			p.pos++
+		}
+		number, err := strconv.ParseFloat(p.expression[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in expression %q", p.expression[start:p.pos], p.expression)
+		}
+		return derivedNumber(number), nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.expression) && (p.expression[p.pos] == '_' || unicode.IsLetter(rune(p.expression[p.pos])) || unicode.IsDigit(rune(p.expression[p.pos]))) {
+			p.pos++
+		}
+		name := p.expression[start:p.pos]
+		p.queries = append(p.queries, name)
+		return derivedQuery(name), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d of expression %q", c, p.pos, p.expression)
+}
+
+// skipSpace advances past whitespace.
+func (p *derivedParser) skipSpace() {
+	for p.pos < len(p.expression) && unicode.IsSpace(rune(p.expression[p.pos])) {
+		p.pos++
+	}
+}
+
+// parsedDerivedMetric is a derived metric with its parsed expression and descriptor.
+type parsedDerivedMetric struct {
+	expr derivedExpr
+	desc *prometheus.Desc
+}
+
+// derivedCollector exports the derived metrics, computed at scrape time from the latest results of the queries.
+// It describes no metrics, so the derived metrics can change on config reload.
+type derivedCollector struct {
+	mu      sync.RWMutex
+	metrics []parsedDerivedMetric
+	results map[string]float64
+}
+
+// Collector of the derived_metrics, registered at startup
+var derivedMetrics = &derivedCollector{results: make(map[string]float64)}
+
+func init() {
+	prometheus.MustRegister(derivedMetrics)
+}
+
+// set replaces the derived metrics with those of config, which has been validated.
+func (c *derivedCollector) set(config Config) {
+	metrics := make([]parsedDerivedMetric, 0, len(config.Derived_Metrics))
+	for _, derived := range config.Derived_Metrics {
+		expr, _, err := parseDerivedExpression(derived.Expression)
+		if err != nil {
+			continue
+		}
+		help := derived.Metric_Help
+		if help == "" {
+			help = fmt.Sprintf("Derived from the query results as %s.", derived.Expression)
+		}
+		metrics = append(metrics, parsedDerivedMetric{expr: expr, desc: prometheus.NewDesc(derived.Name, help, nil, nil)})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = metrics
+}
+
+// record stores the latest result of a query returning a single value.
+func (c *derivedCollector) record(name string, value float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[name] = value
+}
+
+// forget removes the result of a query which is no longer running.
+func (c *derivedCollector) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.results, name)
+}
+
+// Describe implements prometheus.Collector. Sending no descriptors makes the collector unchecked.
+func (c *derivedCollector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector, exporting the derived metrics whose queries all have a result.
+func (c *derivedCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, metric := range c.metrics {
+		if value, ok := metric.expr.eval(c.results); ok {
+			ch <- prometheus.MustNewConstMetric(metric.desc, prometheus.GaugeValue, value)
+		}
+	}
+}
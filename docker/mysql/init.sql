@@ -0,0 +1,13 @@
+-- Sample schema queried by docker/query_config.yaml
+CREATE TABLE orders (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    status VARCHAR(16) NOT NULL,
+    total DECIMAL(10, 2) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO orders (status, total) VALUES
+    ('paid', 19.99),
+    ('paid', 5.50),
+    ('shipped', 42.00),
+    ('cancelled', 12.75);
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Timeout of each database ping done by -dry-run
+const dryRunPingTimeout = 5 * time.Second
+
+// dryRun pings every database used by the queries of config once, logging the result of each ping.
+// It reports whether all databases were reachable. No queries are run.
+func dryRun(config Config) bool {
+	ok := true
+	checked := make(map[dbKey]bool)
+
+	for _, conf := range config.Queries {
+		key := queryDBKey(config, conf)
+
+		// Ping every database once, however many queries use it
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+
+		dbConfig, err := queryDBConfig(config, conf)
+		if err != nil {
+			slog.Error("Database check failed", "database", key.String(), "error", err)
+			ok = false
+			continue
+		}
+
+		db, err := openDatabase(conf.Connection, dbConfig)
+		if err != nil {
+			slog.Error("Database check failed", "database", key.String(), "error", err)
+			ok = false
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), dryRunPingTimeout)
+		err = sanitizePoolError(db, db.PingContext(ctx))
+		cancel()
+		closeDatabase(key, db)
+
+		if err != nil {
+			slog.Error("Database check failed", "database", key.String(), "error", err)
+			ok = false
+			continue
+		}
+		slog.Info("Database check succeeded", "database", key.String())
+	}
+
+	return ok
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func FuzzReadConfig(f *testing.F) {
+	f.Add([]byte(testConfig), configFormatYAML)
+	f.Add([]byte(benchmarkConfig(3)), configFormatYAML)
+	f.Add([]byte(`{"exporter_port": 2112, "queries": [{"name": "users", "query": "SELECT 1", "interval": "30s"}]}`), configFormatJSON)
+	f.Add([]byte("exporter_port = 2112\n[[queries]]\nname = \"users\"\nquery = \"SELECT 1\"\ninterval = \"30s\"\n"), configFormatTOML)
+	f.Add([]byte("queries:\n  - name: users\n    interval: 5x\n"), configFormatYAML)
+	f.Add([]byte("queries:\n  - name: [\n"), configFormatYAML)
+	f.Add([]byte("db_password: ${UNSET_FUZZ_VARIABLE}\n"), configFormatYAML)
+	f.Add([]byte("a: &a [*a]\n"), configFormatYAML)
+	f.Add([]byte{}, configFormatYAML)
+
+	dir := f.TempDir()
+	f.Fuzz(func(t *testing.T, data []byte, format string) {
+		path := filepath.Join(dir, "config")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		// Invalid input must be reported as an error, and whatever was read must be safe to validate
+		config, err := readConfig(path, format)
+		if err != nil {
+			return
+		}
+		validateConfig(config)
+	})
+}
+
+func FuzzCheckSQLSyntax(f *testing.F) {
+	for _, query := range []string{
+		"SELECT COUNT(*) FROM users",
+		"/* comment */ SELECT 1 -- trailing\n",
+		"WITH recent AS (SELECT id FROM orders) SELECT COUNT(*) FROM recent",
+		"SHOW GLOBAL STATUS LIKE 'Threads_connected'",
+		"SELECT 'unterminated",
+		"SELECT 1; DELETE FROM users",
+		"/* unterminated comment",
+		"",
+	} {
+		f.Add(query)
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		// Any query is either accepted or rejected with an error, without panicking
+		checkSQLSyntax(query)
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Timeout of the /healthz database pings when healthcheck_timeout is not configured
+const defaultHealthcheckTimeout = 3 * time.Second
+
+// Status of a single database reported by /healthz
+type databaseHealth struct {
+	Database string `json:"database"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Body of the /healthz response
+type healthResponse struct {
+	Status    string           `json:"status"`
+	Databases []databaseHealth `json:"databases"`
+}
+
+// healthHandler returns a handler that pings every database connection pool returned by databases.
+// It responds with HTTP 200 when all databases are reachable and HTTP 503 otherwise.
+func healthHandler(databases func() map[dbKey]*sql.DB, timeout time.Duration) http.HandlerFunc {
+	if timeout <= 0 {
+		timeout = defaultHealthcheckTimeout
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Bound all pings by the healthcheck timeout so probes don't time out
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		// Ping all databases concurrently
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		response := healthResponse{Status: "ok", Databases: []databaseHealth{}}
+
+		for key, db := range databases() {
+			wg.Add(1)
+			go func(key dbKey, db *sql.DB) {
+				defer wg.Done()
+
+				health := databaseHealth{Database: key.String(), Status: "up"}
+				if err := db.PingContext(ctx); err != nil {
+					health.Status = "down"
+					health.Error = sanitizePoolError(db, err).Error()
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				response.Databases = append(response.Databases, health)
+				if health.Status != "up" {
+					response.Status = "unavailable"
+				}
+			}(key, db)
+		}
+
+		wg.Wait()
+
+		// Sort the databases so responses are stable
+		sort.Slice(response.Databases, func(i, j int) bool {
+			return response.Databases[i].Database < response.Databases[j].Database
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if response.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			slog.Error("Error writing healthcheck response", "error", err)
+		}
+	}
+}
+
+// readiness tracks which configured queries have not succeeded yet.
+// The exporter is ready once every query has succeeded at least once.
+type readiness struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	// Closed when a query succeeds, to wake up the queries waiting for it. Nil while no query waits.
+	changed chan struct{}
+}
+
+// Readiness of the configured queries, reported by /ready
+var queryReadiness = &readiness{pending: make(map[string]bool)}
+
+// expect marks a query as not succeeded yet.
+func (r *readiness) expect(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending[name] = true
+}
+
+// succeeded records that a query has succeeded. It is also used to forget about removed queries.
+func (r *readiness) succeeded(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.pending, name)
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+}
+
+// waitFor waits until none of the named queries is pending. It returns false when ctx is cancelled first.
+func (r *readiness) waitFor(ctx context.Context, names []string) bool {
+	for {
+		r.mu.Lock()
+		waiting := false
+		for _, name := range names {
+			waiting = waiting || r.pending[name]
+		}
+		if !waiting {
+			r.mu.Unlock()
+			return true
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// pendingQueries returns the sorted names of the queries which have not succeeded yet.
+func (r *readiness) pendingQueries() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.pending))
+	for name := range r.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Body of the /ready response
+type readyResponse struct {
+	Status  string   `json:"status"`
+	Pending []string `json:"pending"`
+}
+
+// readyHandler returns a handler that responds with HTTP 200 once every configured query has succeeded at least once
+// and HTTP 503 listing the pending queries until then.
+func readyHandler(r *readiness) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		response := readyResponse{Status: "ready", Pending: r.pendingQueries()}
+
+		w.Header().Set("Content-Type", "application/json")
+		if len(response.Pending) > 0 {
+			response.Status = "not ready"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			slog.Error("Error writing readiness response", "error", err)
+		}
+	}
+}
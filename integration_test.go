@@ -0,0 +1,336 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// Image and credentials of the MySQL server started for the integration tests
+const (
+	integrationImage    = "mysql:8.0"
+	integrationPassword = "exporter-test"
+	integrationDatabase = "exporter"
+)
+
+// Directory the TLS files are copied to in the MySQL container
+const integrationCertsDir = "/etc/mysql/certs"
+
+// startMySQL starts a MySQL server in a container removed at the end of the test and returns the database to connect to.
+// When certs is set the server only accepts TLS connections, using the server certificate signed by the CA of certs.
+// The test is skipped when Docker isn't available.
+func startMySQL(t *testing.T, certs *testCerts) DBConfig {
+	t.Helper()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+
+	request := testcontainers.ContainerRequest{
+		Image:        integrationImage,
+		ExposedPorts: []string{"3306/tcp"},
+		Env: map[string]string{
+			"MYSQL_ROOT_PASSWORD": integrationPassword,
+			"MYSQL_DATABASE":      integrationDatabase,
+		},
+		// The entrypoint first starts a temporary server on port 0 to initialize the database
+		WaitingFor: wait.ForLog("port: 3306  MySQL Community Server").WithStartupTimeout(3 * time.Minute),
+	}
+	if certs != nil {
+		for _, file := range []string{certs.CA, certs.ServerCert, certs.ServerKey} {
+			request.Files = append(request.Files, testcontainers.ContainerFile{
+				HostFilePath:      file,
+				ContainerFilePath: path.Join(integrationCertsDir, path.Base(file)),
+				FileMode:          0o644,
+			})
+		}
+		request.Cmd = []string{
+			"--ssl-ca=" + path.Join(integrationCertsDir, path.Base(certs.CA)),
+			"--ssl-cert=" + path.Join(integrationCertsDir, path.Base(certs.ServerCert)),
+			"--ssl-key=" + path.Join(integrationCertsDir, path.Base(certs.ServerKey)),
+			"--require-secure-transport=ON",
+		}
+	}
+
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{ContainerRequest: request, Started: true})
+	if err != nil {
+		t.Fatalf("Error starting MySQL: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := container.Terminate(context.Background()); err != nil {
+			t.Errorf("Error stopping MySQL: %v", err)
+		}
+	})
+
+	host, err := container.Host(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := container.MappedPort(ctx, "3306/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DBConfig{Host: host, Port: port.Int(), User: "root", Password: integrationPassword, Database: integrationDatabase}
+}
+
+func TestIntegrationTLS(t *testing.T) {
+	certs := generateTestCerts(t, t.TempDir())
+	server := startMySQL(t, &certs)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	t.Run("verified", func(t *testing.T) {
+		dbConfig := server
+		dbConfig.Name = "tls_verified"
+		dbConfig.TLS_CA = certs.CA
+		dbConfig.TLS_Cert, dbConfig.TLS_Key = certs.ClientCert, certs.ClientKey
+		db, err := openDatabase(dbConfig.Name, dbConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		// The session status names the TLS version of encrypted connections
+		var name, version string
+		if err := db.QueryRowContext(ctx, "SHOW SESSION STATUS LIKE 'Ssl_version'").Scan(&name, &version); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(version, "TLS") {
+			t.Errorf("Ssl_version = %q, want a TLS version", version)
+		}
+	})
+
+	t.Run("unknown CA", func(t *testing.T) {
+		otherCerts := generateTestCerts(t, t.TempDir())
+		dbConfig := server
+		dbConfig.Name = "tls_unknown_ca"
+		dbConfig.TLS_CA = otherCerts.CA
+		db, err := openDatabase(dbConfig.Name, dbConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if err := db.PingContext(ctx); err == nil || !strings.Contains(err.Error(), "certificate") {
+			t.Errorf("got error %v, want a certificate verification error", err)
+		}
+	})
+
+	t.Run("skip verify", func(t *testing.T) {
+		dbConfig := server
+		dbConfig.TLS_Skip_Verify = true
+		db, err := openDatabase(dbConfig.Name, dbConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if err := db.PingContext(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("plain text", func(t *testing.T) {
+		db, err := openDatabase(server.Name, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		// The server requires secure transport, so it refuses unencrypted connections
+		if err := db.PingContext(ctx); err == nil {
+			t.Error("unencrypted connection succeeded")
+		}
+	})
+}
+
+// integrationConfig returns a config whose top-level database is server, running queries.
+func integrationConfig(server DBConfig, queries ...Query) Config {
+	return Config{DB_Host: server.Host, DB_Port: server.Port, DB_User: server.User, DB_Password: server.Password, Queries: queries}
+}
+
+// openIntegrationDatabase opens the connection pool a query of config runs on, closed at the end of the test.
+func openIntegrationDatabase(t *testing.T, config Config, conf Query) (*sql.DB, dbKey) {
+	t.Helper()
+	dbConfig, err := queryDBConfig(config, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabase(conf.Connection, dbConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, queryDBKey(config, conf)
+}
+
+// populateTestSchema creates the users table queried by the integration tests, with three users of which one is deleted.
+func populateTestSchema(t *testing.T, db *sql.DB) {
+	t.Helper()
+	for _, statement := range []string{
+		"CREATE TABLE users (id INT PRIMARY KEY, email VARCHAR(255) NOT NULL, deleted_at DATETIME NULL)",
+		"INSERT INTO users VALUES (1, 'ada@example.com', NULL), (2, 'grace@example.com', NULL), (3, 'linus@example.com', NOW())",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// resultValue returns the value the result of a query read from the database key is exported as.
+func resultValue(key dbKey, conf Query) float64 {
+	return testutil.ToFloat64(queryMetric.WithLabelValues(conf.Name, conf.Query, key.host(), key.Database))
+}
+
+// closedPort returns a local TCP port nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+func TestIntegrationCheckQuery(t *testing.T) {
+	server := startMySQL(t, nil)
+	config := integrationConfig(server)
+	setup, _ := openIntegrationDatabase(t, config, Query{Database: integrationDatabase})
+	populateTestSchema(t, setup)
+
+	t.Run("success", func(t *testing.T) {
+		conf := Query{Name: "integration_active_users", Query: "SELECT COUNT(*) FROM users WHERE deleted_at IS NULL", Database: integrationDatabase}
+		db, key := openIntegrationDatabase(t, config, conf)
+
+		checkQuery(context.Background(), db, key, conf)
+
+		if value := resultValue(key, conf); value != 2 {
+			t.Errorf("result = %g, want 2", value)
+		}
+	})
+
+	t.Run("null", func(t *testing.T) {
+		conf := Query{Name: "integration_null", Query: "SELECT SUM(id) FROM users WHERE id > 100", Database: integrationDatabase, Null_Value: -1}
+		db, key := openIntegrationDatabase(t, config, conf)
+
+		checkQuery(context.Background(), db, key, conf)
+
+		if value := resultValue(key, conf); value != -1 {
+			t.Errorf("result = %g, want the null_value -1", value)
+		}
+	})
+
+	t.Run("connection failure", func(t *testing.T) {
+		conf := Query{Name: "integration_unreachable", Query: "SELECT COUNT(*) FROM users", Database: integrationDatabase, Connection_Timeout: 5 * time.Second}
+		unreachable := config
+		unreachable.DB_Host, unreachable.DB_Port = "127.0.0.1", closedPort(t)
+		db, key := openIntegrationDatabase(t, unreachable, conf)
+		connectionErrors := queryErrors.WithLabelValues(conf.Name, queryErrorConnection)
+		before := testutil.ToFloat64(connectionErrors)
+
+		checkQuery(context.Background(), db, key, conf)
+
+		if count := testutil.ToFloat64(connectionErrors) - before; count != 1 {
+			t.Errorf("counted %g connection errors, want 1", count)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		conf := Query{Name: "integration_timeout", Query: "SELECT SLEEP(10)", Database: integrationDatabase, Query_Timeout: 500 * time.Millisecond}
+		db, key := openIntegrationDatabase(t, config, conf)
+		timeouts := queryTimeouts.WithLabelValues(conf.Name)
+		before := testutil.ToFloat64(timeouts)
+
+		start := time.Now()
+		checkQuery(context.Background(), db, key, conf)
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("query ran for %s, want it cancelled after its 500ms timeout", elapsed)
+		}
+		if count := testutil.ToFloat64(timeouts) - before; count != 1 {
+			t.Errorf("counted %g timeouts, want 1", count)
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		conf := Query{Name: "integration_cancelled", Query: "SELECT SLEEP(10)", Database: integrationDatabase}
+		db, key := openIntegrationDatabase(t, config, conf)
+		timeouts := queryTimeouts.WithLabelValues(conf.Name)
+		before := testutil.ToFloat64(timeouts)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		checkQuery(ctx, db, key, conf)
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("query ran for %s, want it cancelled with its context", elapsed)
+		}
+		// Cancellation by the exporter isn't a query timeout
+		if count := testutil.ToFloat64(timeouts) - before; count != 0 {
+			t.Errorf("counted %g timeouts, want none", count)
+		}
+	})
+}
+
+func TestIntegrationScheduler(t *testing.T) {
+	server := startMySQL(t, nil)
+	conf := Query{Name: "integration_scheduled_users", Query: "SELECT COUNT(*) FROM users", Database: integrationDatabase, Interval: time.Hour}
+	config := integrationConfig(server, conf)
+	setup, _ := openIntegrationDatabase(t, config, conf)
+	populateTestSchema(t, setup)
+
+	s := newScheduler(context.Background())
+	t.Cleanup(func() {
+		if err := s.apply(integrationConfig(server)); err != nil {
+			t.Error(err)
+		}
+		s.stop(5 * time.Second)
+	})
+	if err := s.apply(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// The query runs as soon as it is scheduled
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if !queryReadiness.waitFor(ctx, []string{conf.Name}) {
+		t.Fatalf("query %s didn't succeed", conf.Name)
+	}
+
+	// The result is served on /metrics
+	web := httptest.NewServer(newMetricsHandler(metricsGatherer))
+	defer web.Close()
+	resp, err := http.Get(web.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, defaultMetricName+"{") && strings.Contains(line, `name="`+conf.Name+`"`) {
+			if !strings.HasSuffix(line, " 3") {
+				t.Errorf("got %q, want the result 3", line)
+			}
+			return
+		}
+	}
+	t.Errorf("result of %s not found in:\n%s", conf.Name, body)
+}
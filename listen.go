@@ -0,0 +1,112 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Struct for entries of the listen_addresses list in yaml file
+type ListenAddress struct {
+	// Port the metrics of the entry are served on
+	Port int `yaml:"port" json:"port" toml:"port"`
+	// Optional names of the queries whose metrics are served. All queries are served when empty.
+	Query_Filter []string `yaml:"query_filter" json:"query_filter" toml:"query_filter"`
+}
+
+// Label holding the query name on every query metric
+const queryNameLabel = "name"
+
+// queryFilterGatherer only keeps the series of the queries in queries, identified by their name label, and the
+// derived metrics in queries, identified by their metric name. The statements of a query are exported under names
+// of their own and belong to their query, they are looked up in the queries of running. Metrics which aren't labeled
+// by query, such as the Go runtime metrics, are left out, so a listen address only exposes what belongs to its queries.
+// A nil queries keeps everything.
+type queryFilterGatherer struct {
+	gatherer prometheus.Gatherer
+	queries  map[string]bool
+	running  func() Config
+}
+
+// Gather implements prometheus.Gatherer.
+func (g queryFilterGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	if g.queries == nil {
+		return families, err
+	}
+
+	queries := g.queries
+	if g.running != nil {
+		queries = maps.Clone(g.queries)
+		for _, conf := range g.running().Queries {
+			if g.queries[conf.Name] {
+				for _, statement := range statementQueries(conf) {
+					queries[statement.Name] = true
+				}
+			}
+		}
+	}
+
+	filtered := make([]*dto.MetricFamily, 0, len(families))
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.Metric {
+			if name, ok := queryNameOf(metric); ok && queries[name] || !ok && g.queries[family.GetName()] {
+				metrics = append(metrics, metric)
+			}
+		}
+		if len(metrics) > 0 {
+			filtered = append(filtered, &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type, Metric: metrics})
+		}
+	}
+	return filtered, err
+}
+
+// queryNameOf returns the value of the name label of a series, and false when the series isn't labeled by query.
+func queryNameOf(metric *dto.Metric) (string, bool) {
+	for _, pair := range metric.Label {
+		if pair.GetName() == queryNameLabel {
+			return pair.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// Gatherers of the listen_addresses, relabelled with the same rules as metricsGatherer
+var (
+	listenGatherersMu sync.Mutex
+	listenGatherers   []*relabelGatherer
+)
+
+// newListenGatherer returns the gatherer of the metrics served on a listen address: the metrics of the
+// queries and derived metrics in its query_filter, relabelled with the metric_relabel_configs. The queries are filtered
+// before relabelling, so rules renaming or dropping the name label don't change what is served.
+func newListenGatherer(listen ListenAddress) *relabelGatherer {
+	var queries map[string]bool
+	if len(listen.Query_Filter) > 0 {
+		queries = make(map[string]bool, len(listen.Query_Filter))
+		for _, name := range listen.Query_Filter {
+			queries[name] = true
+		}
+	}
+
+	metricsGatherer.mu.RLock()
+	gatherer := &relabelGatherer{gatherer: queryFilterGatherer{gatherer: prometheus.DefaultGatherer, queries: queries, running: runningConfig.get}, rules: metricsGatherer.rules}
+	metricsGatherer.mu.RUnlock()
+
+	listenGatherersMu.Lock()
+	defer listenGatherersMu.Unlock()
+	listenGatherers = append(listenGatherers, gatherer)
+	return gatherer
+}
+
+// listenAddressHandler returns the handler of a listen address, serving the metrics of its queries on
+// /metrics with the same authentication as the main port.
+func listenAddressHandler(config Config, listen ListenAddress) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", basicAuth(newMetricsHandler(newListenGatherer(listen)), config.Web_Auth_Username, config.Web_Auth_Password_Hash))
+	return mux
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestQueryFilterGathererServesStatementsAndDerivedMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	results := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_query_result", Help: "Test results."}, []string{queryNameLabel})
+	errorRate := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_error_rate", Help: "Test derived metric."})
+	goroutines := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_goroutines", Help: "Test metric of no query."})
+	registry.MustRegister(results, errorRate, goroutines)
+	for _, name := range []string{"recent_orders_1", "recent_orders_2", "orders", "orders_2024", "signups"} {
+		results.WithLabelValues(name).Set(1)
+	}
+
+	// orders_2024 is a query of its own, not a statement of orders
+	running := Config{Queries: []Query{
+		{Name: "recent_orders", Statements: []string{"SET @cutoff = NOW()", "SELECT 1", "SELECT 2"}, Interval: time.Minute},
+		{Name: "orders", Query: "SELECT 1", Interval: time.Minute},
+		{Name: "orders_2024", Query: "SELECT 1", Interval: time.Minute},
+		{Name: "signups", Query: "SELECT 1", Interval: time.Minute},
+	}}
+	gatherer := queryFilterGatherer{
+		gatherer: registry,
+		queries:  map[string]bool{"recent_orders": true, "orders": true, "test_error_rate": true},
+		running:  func() Config { return running },
+	}
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served []string
+	for _, family := range families {
+		if family.GetName() == "test_error_rate" {
+			served = append(served, family.GetName())
+		}
+		for _, metric := range family.Metric {
+			if name, ok := queryNameOf(metric); ok {
+				served = append(served, name)
+			}
+		}
+	}
+	slices.Sort(served)
+
+	want := []string{"orders", "recent_orders_1", "recent_orders_2", "test_error_rate"}
+	if !slices.Equal(served, want) {
+		t.Errorf("served %v, want %v", served, want)
+	}
+}
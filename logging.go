@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Supported values of log_format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Minimum level of the logged messages, changed at runtime with PUT /loglevel
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel returns the slog level named by level: debug, info (default), warn or error.
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log_level %s, must be one of debug, info, warn or error", level)
+	}
+}
+
+// setupLogging replaces the default logger with a structured logger writing to stderr in the given format,
+// dropping messages below level. Messages written with the log package are logged at info level.
+func setupLogging(format string, level string) error {
+	parsed, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(parsed)
+
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+		// Name the standard fields like log aggregation systems expect them
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return attr
+			}
+			switch attr.Key {
+			case slog.TimeKey:
+				attr.Key = "timestamp"
+			case slog.MessageKey:
+				attr.Key = "message"
+			}
+			return attr
+		},
+	}
+
+	var handler slog.Handler
+	switch format {
+	case "", logFormatText:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log_format %s, must be one of %s or %s", format, logFormatText, logFormatJSON)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs msg and args at error level and exits with code 1.
+// Unlike log.Fatalf, the message is logged in the configured format and never dropped by log_level.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logLevelHandler returns a handler that responds with the current log level and changes it on PUT requests.
+// The new level is read from the request body, for example "debug".
+func logLevelHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			level, err := parseLogLevel(strings.TrimSpace(string(body)))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logLevel.Set(level)
+			slog.Info("Changed log level", "log_level", level.String())
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		fmt.Fprintln(w, strings.ToLower(logLevel.Level().String()))
+	}
+}
+
+// queryLogger returns a logger adding the query_name and database fields of a query to every message.
+func queryLogger(conf Query) *slog.Logger {
+	return slog.With("query_name", conf.Name, "database", conf.Database)
+}
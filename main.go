@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,128 +17,200 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"gopkg.in/yaml.v2"
 )
 
-// Struct for Queries in yaml file
-type Query struct {
-	Name     string        `yaml:"name"`
-	Databse  string        `yaml:"database"`
-	Query    string        `yaml:"query"`
-	Interval time.Duration `yaml:"interval"`
+// Timeouts of the HTTP server when web_read_timeout, web_write_timeout and web_idle_timeout are not configured
+const (
+	defaultWebReadTimeout  = 5 * time.Second
+	defaultWebWriteTimeout = 10 * time.Second
+	defaultWebIdleTimeout  = 120 * time.Second
+)
+
+// Maximum duration of the graceful shutdown of the HTTP server when shutdown_timeout is not configured
+const defaultShutdownTimeout = 30 * time.Second
+
+// newMetricsHandler returns the handler serving the metrics of gatherer on /metrics.
+// The OpenMetrics format is served to scrapers asking for it in their Accept header, the Prometheus text format otherwise.
+// Exemplars linking the metrics to traces are only exposed in the OpenMetrics format.
+// Scrapes are served the metrics gathered last when gathering takes longer than scrape_timeout.
+func newMetricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(newScrapeCache(gatherer), promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
 }
 
-// Struct for yaml config file
-type Config struct {
-	Exporter_Port int    `yaml:"exporter_port"`
-	DB_Host       string `yaml:"db_host"`
-	DB_Port       int    `yaml:"db_port"`
-	DB_User       string `yaml:"db_user"`
-	DB_Password   string `yaml:"db_password"`
-	Queries       []Query
+// durationOrDefault returns d, or fallback when d is zero.
+func durationOrDefault(d time.Duration, fallback time.Duration) time.Duration {
+	if d == 0 {
+		return fallback
+	}
+	return d
 }
 
-// Defining prometheus metric type
-var (
-	queryMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "mysql_query_exporter",
-		Help: "The number of rows returned by specified MySQL count queries, labeled by query name and SQL statement.",
-	},
-		[]string{"name", "query"},
-	)
-)
+func main() {
+	// Measure the startup until scrapes are accepted, exported as mysql_query_exporter_startup_seconds
+	startTime := time.Now()
+
+	// The hash-password subcommand prints the bcrypt hash of a password read from stdin, for web_auth_password_hash
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		fmt.Fprintln(os.Stderr, "Enter the password:")
+		if err := hashPassword(os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("Error generating password hash: %v", err)
+		}
+		return
+	}
 
-func init() {
-	prometheus.MustRegister(queryMetric)
-}
+	// The check-config subcommand validates a configuration without connecting to any database, for linting in CI
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		if !checkConfig(os.Args[2:], os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
 
-func readConfig(filename string) (Config, error) {
-	bytes, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return Config{}, err
+	// The generate-service-monitor subcommand prints a Prometheus Operator ServiceMonitor scraping the exporter as configured
+	if len(os.Args) > 1 && os.Args[1] == "generate-service-monitor" {
+		if !generateServiceMonitor(os.Args[2:], os.Stdout, os.Stderr) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	var config Config
+	// Define a command line flag for the configuration file path
+	configPath := flag.String("config", defaultConfigPath(), "path or http(s) URL of the YAML, JSON or TOML configuration file, MQCE_CONFIG sets the default")
 
-	err = yaml.Unmarshal(bytes, &config)
+	// Define command line flags for fetching the configuration from a URL
+	configAuthToken := flag.String("config-auth-token", "", "bearer token sent when fetching the configuration from a URL")
+	configRefreshInterval := flag.Duration("config-refresh-interval", 5*time.Minute, "how often to re-fetch a configuration served from a URL, 0 disables re-fetching")
 
-	if err != nil {
-		return Config{}, err
-	}
+	// Define a command line flag to reload the configuration file when it changes, such as a Kubernetes ConfigMap
+	watchConfigFile := flag.Bool("watch-config", false, "reload the configuration file when it changes")
 
-	return config, nil
-}
+	// Define a command line flag to check the configuration and the database connections, then exit
+	dryRunFlag := flag.Bool("dry-run", false, "validate the configuration and ping every database, then exit with code 0 on success or 1 on failure")
 
-// checkQuery connects to the database, runs a query, and sends the results to Prometheus.
-// It uses the provided context to support cancellation.
+	// Define a command line flag to override the log_level of the configuration
+	logLevelFlag := flag.String("log-level", "", "minimum level of the logged messages: debug, info, warn or error (default log_level of the configuration)")
 
-func checkQuery(ctx context.Context, user string, password string, host string, port int, database string, query string, name string, interval time.Duration) {
-	// Log that the function is attempting to connect to the database
-	log.Printf("[%s] Attemping connection", database)
+	// Define a command line flag to run every query once and print the results instead of serving them
+	onceFlag := flag.Bool("once", false, "run every query once, print the results to stdout and exit with code 0 if all queries succeeded or 1 otherwise")
 
-	// Open a connection to the MySQL database
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", user, password, host, port, database))
+	// Define a command line flag to run a single query once and print its result, for trying out a new query
+	testQueryFlag := flag.String("test-query", "", "run only the query with this name once, print its result and execution time and exit with code 0 if it succeeded or 1 otherwise")
 
-	// If there was an error opening the connection, log it
-	if err != nil {
-		log.Printf("[%s] Error connecting to database@%s: %v", database, host, err)
-	}
+	// Define a command line flag to override the configuration format detected from the file extension
+	configFormat := flag.String("config-format", "", "format of the configuration file: yaml, json or toml (default detected from the file extension)")
 
-	// Log that the connection was established successfully
-	log.Printf("[%s] Connection established", database)
+	// Define command line flags overriding the port and the default database of the configuration,
+	// so one configuration file can be deployed to several environments
+	var overrides configOverrides
+	flag.IntVar(&overrides.port, "port", 0, "port the exporter listens on (default exporter_port of the configuration)")
+	flag.StringVar(&overrides.dbHost, "db-host", "", "host of the default database (default db_host of the configuration)")
+	flag.IntVar(&overrides.dbPort, "db-port", 0, "port of the default database (default db_port of the configuration)")
+	flag.StringVar(&overrides.dbUser, "db-user", "", "user of the default database (default db_user of the configuration)")
+	flag.StringVar(&overrides.dbPassword, "db-password", "", "password of the default database (default db_password of the configuration)")
 
-	// Ensure the database connection is closed when the function returns
-	defer db.Close()
+	// Define a command line flag to print the build information, for checking which version is deployed
+	versionFlag := flag.Bool("version", false, "print the version, commit and build date and exit")
 
-	// Declare a variable to store the result count
-	var count int
+	// Parse the flags.
+	flag.Parse()
 
-	// Log that the function is running the provided query
-	log.Printf("[%s] Running Query %s", database, query)
+	if *versionFlag {
+		fmt.Println(versionString())
+		return
+	}
 
-	// Run the query and store the result in the count variable
-	err = db.QueryRow(query).Scan(&count)
+	// Reading config file
+	config, err := loadConfig(*configPath, *configFormat, *configAuthToken)
 
-	// If there was an error running the query, log it
+	// If there was an error reading the configuration, log it and exit
 	if err != nil {
-		log.Printf("[%s] Error executing query %s: %v", database, query, err)
+		log.Fatalf("Error reading hosts yaml file: %v", err)
+	}
+
+	// The command line flags take precedence over the configuration file
+	overrides.apply(&config)
+
+	// Validate the configuration before starting anything, reporting every problem at once
+	if errs := validateConfig(config); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Invalid configuration: %v", err)
+		}
+		log.Fatalf("Found %d errors in configuration file %s", len(errs), *configPath)
 	}
 
-	// Log that the query completed successfully
-	log.Printf("[%s] Query complete", database)
+	// Log in the configured format and level from now on, the -log-level flag takes precedence over log_level
+	level := config.Log_Level
+	if *logLevelFlag != "" {
+		level = *logLevelFlag
+	}
+	if err := setupLogging(config.Log_Format, level); err != nil {
+		log.Fatalf("Error setting up logging: %v", err)
+	}
 
-	// Log the query result
-	log.Printf("[%s] Count: %d", database, count)
+	// Comment the SQL sent to the database unless add_query_comment is false
+	setQueryComment(config)
 
-	// Send the query result to Prometheus
-	queryMetric.WithLabelValues(name, query).Set(float64(count))
+	// Bound how long scrapes wait for the metrics to be gathered
+	setScrapeTimeout(config)
 
-	// Wait for either the context to be cancelled or for the interval to pass
-	select {
-	case <-time.After(interval * time.Second):
-		// Sleep duration elapsed
-	case <-ctx.Done():
-		// Context cancelled
+	// In dry run mode nothing is started, the databases are only pinged
+	if *dryRunFlag {
+		if !dryRun(config) {
+			fatal("Dry run failed, not all databases are reachable")
+		}
+		log.Printf("Dry run succeeded, configuration %s is valid", *configPath)
 		return
 	}
-}
 
-func main() {
+	// Register the shared query result metrics with the extra labels of the queries
+	if err := registerResultMetrics(config); err != nil {
+		fatal("Error registering query result metrics", "error", err)
+	}
 
-	// Define a command line flag for the configuration file path
-	configPath := flag.String("config", "query_config.yaml", "path to the YAML configuration file")
+	// Register the query duration histogram with the configured buckets
+	if err := registerDurationMetric(config.Histogram_Buckets); err != nil {
+		fatal("Error registering query duration metric", "error", err)
+	}
 
-	// Parse the flags.
-	flag.Parse()
+	// Trace the query executions when a collector is configured, flushing the spans on exit
+	shutdownTracing, err := setupTracing(config.Otel_Endpoint)
+	if err != nil {
+		fatal("Error setting up tracing", "error", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("Error flushing traces", "error", err)
+		}
+	}()
 
-	// Reading config yaml file
-	config, err := readConfig(*configPath)
+	// In test query mode only the named query is run, once
+	if *testQueryFlag != "" {
+		if !testQuery(context.Background(), config, *testQueryFlag, os.Stdout) {
+			fatal("Query test failed", "query_name", *testQueryFlag)
+		}
+		return
+	}
 
-	// If there was an error reading the configuration, log it and exit
-	if err != nil {
-		log.Fatalf("Error reading hosts yaml file: %v", err)
+	// In once mode the queries are run one after the other and no server is started
+	if *onceFlag {
+		if !runOnce(context.Background(), config, os.Stdout) {
+			fatal("Not all queries succeeded")
+		}
+		return
 	}
 
+	// Relabel the exposed metrics with the configured rules and compute the derived metrics
+	setRelabelConfigs(config)
+	derivedMetrics.set(config)
+
+	// Push the metrics to the Pushgateway after each query in push mode
+	setupPush(config)
+
+	// Send the alerts of the queries while the exporter runs
+	queryAlerts = newAlertNotifier()
+
 	// Create a cancellable context
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -152,63 +225,207 @@ func main() {
 	// Start a goroutine that waits for a signal and then cancels the context
 	go func() {
 		sig := <-signalCh
-		fmt.Printf("Received signal: %s. Exiting...\n", sig)
+		slog.Info("Received signal, exiting", "signal", sig.String())
 		cancel() // This will cancel the context
-		fmt.Println("Cancel function called.")
+		slog.Info("Cancel function called")
+	}()
+
+	// Open one connection pool per unique database so queries reuse connections between runs,
+	// register the metrics of the queries and start a goroutine per query
+	sched := newScheduler(ctx)
+	if err := sched.apply(config); err != nil {
+		fatal("Error starting queries", "error", err)
+	}
+
+	// Record when the configuration was loaded and report it on /config
+	configReloadTimestamp.SetToCurrentTime()
+	runningConfig.set(config)
+
+	// Ensure the query goroutines are stopped and the connection pools closed when the exporter exits.
+	// This runs after the HTTP server is shut down, waiting for in-flight queries for at most the shutdown timeout.
+	defer func() {
+		sched.stop(durationOrDefault(runningConfig.get().Shutdown_Timeout, defaultShutdownTimeout))
 	}()
 
-	// For each query configuration, start a goroutine that periodically runs the query
-	for _, conf := range config.Queries {
-		go func(conf Query) {
-			ticker := time.NewTicker(conf.Interval)
+	// Establish the database connections before accepting scrapes, so the first scrapes report mysql_query_exporter_db_up.
+	// The queries were started by apply and already run, the query metrics appear as each first run finishes.
+	warmUpDatabases(ctx, sched.databases(), warmUpTimeout)
+
+	// reload re-reads the configuration and applies it, keeping the current configuration on errors
+	reload := func() {
+		newConfig, err := loadConfig(*configPath, *configFormat, *configAuthToken)
+		if err != nil {
+			slog.Error("Error reloading config, keeping the current config", "error", err)
+			return
+		}
+		overrides.apply(&newConfig)
+
+		if errs := validateConfig(newConfig); len(errs) > 0 {
+			for _, err := range errs {
+				slog.Error("Invalid configuration", "error", err)
+			}
+			slog.Error("Found errors in reloaded config, keeping the current config", "errors", len(errs))
+			return
+		}
+
+		// A config applied partially is running, so the rest of it is applied as well
+		var partial *partialApplyError
+		if err := sched.apply(newConfig); errors.As(err, &partial) {
+			slog.Error("Reloaded config applied partially, the queries whose metric couldn't be registered are not running", "error", err)
+		} else if err != nil {
+			slog.Error("Error applying reloaded config, keeping the current config", "error", err)
+			return
+		}
+
+		// Relabel the exposed metrics with the reloaded rules, comment the queries, bound the scrapes and compute the derived metrics as reconfigured
+		setRelabelConfigs(newConfig)
+		setQueryComment(newConfig)
+		setScrapeTimeout(newConfig)
+		derivedMetrics.set(newConfig)
+
+		// Record when the configuration was reloaded and report it on /config
+		configReloadTimestamp.SetToCurrentTime()
+		runningConfig.set(newConfig)
+
+		log.Printf("Config reloaded")
+	}
+
+	// Reload the config file when SIGHUP is received
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+
+	go func() {
+		for range reloadCh {
+			log.Printf("Received SIGHUP, reloading %s", *configPath)
+			reload()
+		}
+	}()
+
+	// Periodically re-fetch a configuration served from a URL so it stays in sync
+	if isConfigURL(*configPath) && *configRefreshInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(*configRefreshInterval)
 			defer ticker.Stop()
 			for {
 				select {
 				case <-ctx.Done():
-					fmt.Println("Received done signal. Exiting goroutine...")
-					// Clean up and stop go routine
 					return
 				case <-ticker.C:
-					checkQuery(ctx, config.DB_User, config.DB_Password, config.DB_Host, config.DB_Port, conf.Databse, conf.Query, conf.Name, conf.Interval)
+					reload()
 				}
 			}
-		}(conf)
+		}()
 	}
 
+	// Reload the config file when it changes on disk
+	if *watchConfigFile {
+		if isConfigURL(*configPath) {
+			log.Printf("Ignoring -watch-config, %s is not a file", *configPath)
+		} else if err := watchConfig(ctx, *configPath, reload); err != nil {
+			fatal("Error watching config file", "error", err)
+		}
+	}
+
+	// Route the status page, metrics, healthcheck and readiness endpoints
+	mux := http.NewServeMux()
+	// The status page shows the query results and errors, so it requires the same authentication as /metrics
+	mux.Handle("/", basicAuth(statusHandler(queryStatuses), config.Web_Auth_Username, config.Web_Auth_Password_Hash))
+	// The metrics handler exposes the default Prometheus registry, relabelled by metricsGatherer, as an HTTP endpoint.
+	// It requires basic authentication when web_auth_username is set.
+	metricsHandler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, newMetricsHandler(metricsGatherer))
+	mux.Handle("/metrics", basicAuth(metricsHandler, config.Web_Auth_Username, config.Web_Auth_Password_Hash))
+	// The names of the exposed metrics, for discovering them without reading the whole /metrics page
+	mux.Handle("/metrics/names", basicAuth(metricNamesHandler(metricsGatherer), config.Web_Auth_Username, config.Web_Auth_Password_Hash))
+	mux.Handle("/healthz", healthHandler(sched.databases, config.Healthcheck_Timeout))
+	mux.Handle("/ready", readyHandler(queryReadiness))
+	// The log level can be changed at runtime, so it requires the same authentication as /metrics
+	mux.Handle("/loglevel", basicAuth(logLevelHandler(), config.Web_Auth_Username, config.Web_Auth_Password_Hash))
+	// The running configuration, with its secrets redacted, requires the same authentication as /metrics
+	mux.Handle("/config", basicAuth(configHandler(runningConfig.get), config.Web_Auth_Username, config.Web_Auth_Password_Hash))
+
 	// Create an instance of the http.Server struct. This allows for more control
 	// over the HTTP server configuration and lifecycle than using http.ListenAndServe directly.
 	srv := &http.Server{
 		// Addr field is the TCP address for the server to listen on. Here it's set to the port specified in the config.
 		Addr: fmt.Sprintf(":%d", config.Exporter_Port),
-		// Handler field is the http.Handler to invoke. promhttp.Handler() returns an HTTP handler
-		// that exposes the default Prometheus registry as an HTTP endpoint.
-		Handler: promhttp.Handler(),
+		// Handler field is the http.Handler to invoke.
+		Handler: mux,
+		// Bound how long slow clients can hold a connection, so they don't leak goroutines
+		ReadTimeout:  durationOrDefault(config.Web_Read_Timeout, defaultWebReadTimeout),
+		WriteTimeout: durationOrDefault(config.Web_Write_Timeout, defaultWebWriteTimeout),
+		IdleTimeout:  durationOrDefault(config.Web_Idle_Timeout, defaultWebIdleTimeout),
 	}
 
-	// Start the server in a separate goroutine so that it doesn't block the main function.
-	// This allows the main function to continue and listen for the context cancellation.
-	go func() {
-		// Log the start of the server.
-		log.Printf("Starting Server on port %d ", config.Exporter_Port)
+	// Serve HTTPS when a certificate is configured, reloading it when the files change
+	useTLS := config.Web_TLS_Cert_File != "" && config.Web_TLS_Key_File != ""
+	if useTLS {
+		certs, err := newCertReloader(config.Web_TLS_Cert_File, config.Web_TLS_Key_File)
+		if err != nil {
+			fatal("Error loading web TLS certificate", "error", err)
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+	}
+
+	// Serve the metrics of the queries of every listen address on its own port, with the settings of the main server
+	servers := []*http.Server{srv}
+	for _, listen := range config.Listen_Addresses {
+		servers = append(servers, &http.Server{
+			Addr:         fmt.Sprintf(":%d", listen.Port),
+			Handler:      listenAddressHandler(config, listen),
+			ReadTimeout:  srv.ReadTimeout,
+			WriteTimeout: srv.WriteTimeout,
+			IdleTimeout:  srv.IdleTimeout,
+			TLSConfig:    srv.TLSConfig,
+		})
+	}
+
+	// The exporter is ready to accept scrapes from here on
+	startupSeconds.Set(time.Since(startTime).Seconds())
 
-		// Call ListenAndServe on the server. This will block until the server is stopped.
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			// If the server is closed normally, ListenAndServe returns http.ErrServerClosed.
-			// If it returns any other error, log this as a fatal error.
-			log.Fatalf("ListenAndServe(): %v", err)
+	// Start the servers in separate goroutines so that they don't block the main function.
+	// This allows the main function to continue and listen for the context cancellation.
+	// In push mode metrics are only pushed, so no server is started.
+	if configMode(config) != modePush {
+		for _, srv := range servers {
+			go func(srv *http.Server) {
+				// Log the start of the server.
+				log.Printf("Starting Server on %s ", srv.Addr)
+
+				// Call ListenAndServe on the server. This will block until the server is stopped.
+				// The certificate is served by srv.TLSConfig, so no files are passed to ListenAndServeTLS.
+				var err error
+				if useTLS {
+					err = srv.ListenAndServeTLS("", "")
+				} else {
+					err = srv.ListenAndServe()
+				}
+				if err != http.ErrServerClosed {
+					// If the server is closed normally, ListenAndServe returns http.ErrServerClosed.
+					// If it returns any other error, log this as a fatal error.
+					fatal("ListenAndServe()", "error", err)
+				}
+			}(srv)
 		}
-	}()
+	}
 
 	// Block and wait for the context to be cancelled. This could be due to receiving a shutdown signal
 	// (like SIGINT or SIGTERM) or due to a call to cancel function somewhere else in your program.
 	<-ctx.Done()
 
 	// Once the context is cancelled, log a shutdown message and attempt to gracefully shutdown the server.
-	// This involves finishing all current requests and then closing the server.
+	// This involves finishing all current requests and then closing the server. Requests still running
+	// after the shutdown timeout are abandoned, so the exporter always exits in bounded time.
 	log.Println("Shutting down the server...")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		// If the server cannot be shutdown cleanly, log the error.
-		log.Printf("Could not shutdown server: %v", err)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), durationOrDefault(runningConfig.get().Shutdown_Timeout, defaultShutdownTimeout))
+	defer cancelShutdown()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err == context.DeadlineExceeded {
+			slog.Warn("Shutdown timeout reached, closing the server with requests in flight", "address", srv.Addr)
+			srv.Close()
+		} else if err != nil {
+			// If the server cannot be shutdown cleanly, log the error.
+			slog.Error("Could not shutdown server", "address", srv.Addr, "error", err)
+		}
 	}
 
 }
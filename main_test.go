@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestMain registers the metrics main registers at startup, which the queries run by the tests export.
+func TestMain(m *testing.M) {
+	if err := registerResultMetrics(Config{}); err != nil {
+		log.Fatalf("Error registering query result metrics: %v", err)
+	}
+	if err := registerDurationMetric(nil); err != nil {
+		log.Fatalf("Error registering query duration metric: %v", err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestMetricsHandlerContentNegotiation(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "negotiation_test", Help: "Test gauge."})
+	gauge.Set(42)
+	registry.MustRegister(gauge)
+	server := httptest.NewServer(newMetricsHandler(registry))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		eof         bool
+	}{
+		{"OpenMetrics", "application/openmetrics-text", "application/openmetrics-text; version=0.0.1", true},
+		// The Accept header sent by Prometheus 2
+		{"Prometheus scrape", "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", "application/openmetrics-text; version=0.0.1", true},
+		{"Prometheus text format", "text/plain", "text/plain; version=0.0.4", false},
+		{"no Accept header", "", "text/plain; version=0.0.4", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, test.contentType) {
+				t.Errorf("got content type %q, want %q", contentType, test.contentType)
+			}
+			if !strings.Contains(string(body), "negotiation_test 42") {
+				t.Errorf("body doesn't contain the gauge:\n%s", body)
+			}
+			// OpenMetrics expositions end with an EOF marker
+			if eof := strings.HasSuffix(string(body), "# EOF\n"); eof != test.eof {
+				t.Errorf("body ends with # EOF: %t, want %t", eof, test.eof)
+			}
+		})
+	}
+}
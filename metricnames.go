@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Name, help text and type of an exposed metric reported by /metrics/names
+type metricName struct {
+	Name string `json:"name"`
+	Help string `json:"help"`
+	Type string `json:"type"`
+}
+
+// metricNamesHandler returns a handler that lists the metrics of gatherer, sorted by name, as JSON.
+func metricNamesHandler(gatherer prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Gather returns the metrics it could gather along with the error, so the list is served either way
+		families, err := gatherer.Gather()
+		if err != nil {
+			slog.Error("Error gathering metrics for /metrics/names", "error", err)
+		}
+
+		names := make([]metricName, 0, len(families))
+		for _, family := range families {
+			names = append(names, metricName{
+				Name: family.GetName(),
+				Help: family.GetHelp(),
+				Type: strings.ToLower(family.GetType().String()),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(names); err != nil {
+			slog.Error("Error writing /metrics/names response", "error", err)
+		}
+	}
+}
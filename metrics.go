@@ -0,0 +1,647 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"modernc.org/sqlite"
+)
+
+// Supported values of the metric_type query field
+const (
+	metricTypeGauge   = "gauge"
+	metricTypeCounter = "counter"
+	metricTypeSummary = "summary"
+	// Set by native_histogram rather than metric_type
+	metricTypeHistogram = "histogram"
+)
+
+// Growth factor of native histogram buckets when native_histogram_bucket_factor is not configured
+const defaultNativeHistogramBucketFactor = 1.1
+
+// Objectives of summaries which don't configure summary_objectives
+var defaultSummaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+// Values of the error_type label of mysql_query_errors_total
+const (
+	queryErrorConnection = "connection"
+	queryErrorQuery      = "query"
+	queryErrorScan       = "scan"
+)
+
+// Default metric_namespace and metric_subsystem, naming the shared metrics mysql_query_exporter and mysql_query_exporter_column
+const (
+	defaultMetricNamespace = "mysql_query"
+	defaultMetricSubsystem = "exporter"
+)
+
+// Names of the metrics shared by all queries without a metric_name, set by registerResultMetrics
+var (
+	defaultMetricName       string
+	defaultColumnMetricName string
+)
+
+// Shared result metrics, registered once the extra labels of the configured queries are known
+var (
+	queryMetric       *prometheus.GaugeVec
+	queryColumnMetric *prometheus.GaugeVec
+)
+
+// Sorted union of the extra_labels keys of all queries, added to every query result metric
+var extraLabelNames []string
+
+// Whether the query result metrics have a query label with the SQL statement, set by registerResultMetrics from disable_query_label
+var queryLabelEnabled = true
+
+// Labels of the query result metrics telling apart the databases, added unless add_db_labels is false
+const (
+	dbHostLabel = "db_host"
+	dbNameLabel = "db_name"
+)
+
+// Whether the query result metrics have the db_host and db_name labels, set by registerResultMetrics from add_db_labels
+var dbLabelsEnabled = true
+
+// Defining prometheus metric type
+var (
+	queryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysql_query_errors_total",
+		Help: "The number of failed executions of specified MySQL queries, labeled by query name and error type.",
+	},
+		[]string{"name", "error_type"},
+	)
+	queryLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysql_query_last_success_timestamp_seconds",
+		Help: "The Unix timestamp of the last successful execution of specified MySQL queries, labeled by query name.",
+	},
+		[]string{"name"},
+	)
+	queryTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysql_query_timeout_total",
+		Help: "The number of executions of specified MySQL queries cancelled by their timeout, labeled by query name.",
+	},
+		[]string{"name"},
+	)
+	queryJitter = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysql_query_jitter_seconds",
+		Help: "The random delay of the first execution of specified MySQL queries, labeled by query name.",
+	},
+		[]string{"name"},
+	)
+	queryPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysql_query_panics_total",
+		Help: "The number of panics recovered while running specified MySQL queries, labeled by query name.",
+	},
+		[]string{"name"},
+	)
+	queryValueClamped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysql_query_value_clamped_total",
+		Help: "The number of results of specified MySQL queries bounded by their clamp_min or clamp_max, labeled by query name.",
+	},
+		[]string{"name"},
+	)
+	queryValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysql_query_validation_failure_total",
+		Help: "The number of results of specified MySQL queries outside of their min_expected and max_expected, labeled by query name.",
+	},
+		[]string{"name"},
+	)
+	queryResultTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysql_query_result_truncated_total",
+		Help: "The number of executions of specified MySQL queries whose result set was cut off at max_query_results rows, labeled by query name.",
+	},
+		[]string{"name"},
+	)
+	queryGoroutineActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysql_query_goroutine_active",
+		Help: "Whether the goroutine running specified MySQL queries is running (1) or exited (0), labeled by query name.",
+	},
+		[]string{"name"},
+	)
+	queryGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mysql_query_goroutines_total",
+		Help: "The number of running query goroutines.",
+	})
+	dbUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysql_query_exporter_db_up",
+		Help: "Whether the last ping of a database, at startup and once per shortest interval of its queries, succeeded (1) or failed (0), labeled by database and db_flavor.",
+	},
+		[]string{"database", "db_flavor"},
+	)
+	configReloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mysql_query_exporter_config_reload_timestamp_seconds",
+		Help: "The Unix timestamp of the last successful (re)load of the configuration.",
+	})
+	queriesConfigured = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mysql_query_exporter_queries_configured_total",
+		Help: "The number of queries in the configuration, including disabled queries.",
+	})
+	queriesActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mysql_query_exporter_queries_active_total",
+		Help: "The number of queries whose goroutine was started by the last (re)load of the configuration.",
+	})
+	queriesDisabled = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mysql_query_exporter_queries_disabled_total",
+		Help: "The number of queries in the configuration which are disabled.",
+	})
+	startupSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mysql_query_exporter_startup_seconds",
+		Help: "The time taken from the start of the exporter until it accepted scrapes, including pre-warming the database connections.",
+	})
+)
+
+// Query duration histogram, registered once the configured buckets are known
+var queryDuration *prometheus.HistogramVec
+
+// Metrics registered for the configured queries, keyed by metric name.
+// Holds dedicated metrics of queries with a metric_name and the shared counter metrics.
+// Guarded by metricsMu because metrics are registered and unregistered on config reload.
+var (
+	metricsMu     sync.RWMutex
+	customMetrics = make(map[string]prometheus.Collector)
+)
+
+// Previous result of every counter series, used to compute the delta added to the counter
+var (
+	counterMu       sync.Mutex
+	counterPrevious = make(map[string]float64)
+)
+
+func init() {
+	prometheus.MustRegister(queryErrors)
+	prometheus.MustRegister(queryLastSuccess)
+	prometheus.MustRegister(queryTimeouts)
+	prometheus.MustRegister(queryJitter)
+	prometheus.MustRegister(queryPanics)
+	prometheus.MustRegister(queryValueClamped)
+	prometheus.MustRegister(queryValidationFailures)
+	prometheus.MustRegister(queryResultTruncated)
+	prometheus.MustRegister(queryGoroutineActive)
+	prometheus.MustRegister(queryGoroutines)
+	prometheus.MustRegister(dbUp)
+	prometheus.MustRegister(configReloadTimestamp)
+	prometheus.MustRegister(queriesConfigured)
+	prometheus.MustRegister(queriesActive)
+	prometheus.MustRegister(queriesDisabled)
+	prometheus.MustRegister(startupSeconds)
+}
+
+// recordQuerySuccess sets the last success timestamp of a query to the current time and marks it as succeeded for /ready.
+func recordQuerySuccess(conf Query) {
+	queryLastSuccess.WithLabelValues(conf.Name).Set(float64(time.Now().Unix()))
+	queryReadiness.succeeded(conf.Name)
+}
+
+// recordQueryError increments the error counter of a query.
+func recordQueryError(conf Query, errorType string) {
+	queryErrors.WithLabelValues(conf.Name, errorType).Inc()
+}
+
+// queryErrorType returns the error_type label value of an error returned while running a query.
+// Errors reported by the database server, missing rows and timeouts are query errors, anything else is a connection error.
+func queryErrorType(err error) string {
+	var mysqlErr *mysql.MySQLError
+	var postgresErr *pq.Error
+	var sqliteErr *sqlite.Error
+	var mssqlErr mssql.Error
+	switch {
+	case errors.As(err, &mysqlErr),
+		errors.As(err, &postgresErr),
+		errors.As(err, &sqliteErr),
+		errors.As(err, &mssqlErr),
+		errors.Is(err, sql.ErrNoRows),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, context.Canceled):
+		return queryErrorQuery
+	default:
+		return queryErrorConnection
+	}
+}
+
+// registerDurationMetric registers the query duration histogram.
+// When no buckets are configured the Prometheus default buckets are used.
+func registerDurationMetric(buckets []float64) error {
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mysql_query_duration_seconds",
+		Help:    "The time taken to execute specified MySQL queries, labeled by query name.",
+		Buckets: buckets,
+	},
+		[]string{"name"},
+	)
+
+	return prometheus.Register(queryDuration)
+}
+
+// registerResultMetrics registers the shared query result metrics with the union of the extra label keys of all queries,
+// named after metric_namespace and metric_subsystem.
+// Prometheus doesn't allow the labels of a metric to change, so the extra label keys are fixed from then on.
+func registerResultMetrics(config Config) error {
+	keys := make(map[string]bool)
+	for _, conf := range config.Queries {
+		for key := range conf.Extra_Labels {
+			keys[key] = true
+		}
+	}
+
+	extraLabelNames = make([]string, 0, len(keys))
+	for key := range keys {
+		extraLabelNames = append(extraLabelNames, key)
+	}
+	sort.Strings(extraLabelNames)
+
+	defaultMetricName, defaultColumnMetricName = sharedMetricNames(config)
+	queryLabelEnabled = !config.Disable_Query_Label
+	dbLabelsEnabled = config.Add_DB_Labels == nil || *config.Add_DB_Labels
+
+	queryMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: defaultMetricName,
+		Help: "The number of rows returned by specified MySQL count queries, labeled by query name and SQL statement.",
+	},
+		queryLabelNames(Query{}),
+	)
+	queryColumnMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: defaultColumnMetricName,
+		Help: "The column values returned by specified MySQL multi column queries, labeled by query name, SQL statement, row and column name.",
+	},
+		queryLabelNames(Query{Multi_Column: true}),
+	)
+
+	if err := prometheus.Register(queryMetric); err != nil {
+		return err
+	}
+	return prometheus.Register(queryColumnMetric)
+}
+
+// sharedMetricNames returns the names of the metrics shared by all queries without a metric_name,
+// <namespace>_<subsystem> for count queries and <namespace>_<subsystem>_column for multi column queries.
+func sharedMetricNames(config Config) (string, string) {
+	namespace, subsystem := config.Metric_Namespace, config.Metric_Subsystem
+	if namespace == "" {
+		namespace = defaultMetricNamespace
+	}
+	if subsystem == "" {
+		subsystem = defaultMetricSubsystem
+	}
+	// BuildFQName drops empty parts, so the subsystem is passed as name to join it to the namespace
+	return prometheus.BuildFQName(namespace, "", subsystem), prometheus.BuildFQName(namespace, subsystem, "column")
+}
+
+// queryMetricType returns the metric type of a query, defaulting to gauge.
+// Queries with native_histogram are histograms.
+func queryMetricType(conf Query) string {
+	if conf.Native_Histogram {
+		return metricTypeHistogram
+	}
+	if conf.Metric_Type == "" {
+		return metricTypeGauge
+	}
+	return conf.Metric_Type
+}
+
+// queryLabelNames returns the label names of the metric a query is exported on, followed by the extra label names.
+// The query label is left out when disable_query_label is set, the db_host and db_name labels when add_db_labels is false.
+func queryLabelNames(conf Query) []string {
+	names := []string{"name"}
+	if queryLabelEnabled {
+		names = append(names, "query")
+	}
+	if dbLabelsEnabled {
+		names = append(names, dbHostLabel, dbNameLabel)
+	}
+	names = append(names, resultLabelNames(conf)...)
+	return append(names, extraLabelNames...)
+}
+
+// resultLabelNames returns the names of the labels telling apart the rows and columns of the result of a query.
+func resultLabelNames(conf Query) []string {
+	switch {
+	case conf.Multi_Column:
+		return []string{"row", "column"}
+	case conf.Multi_Row:
+		return []string{conf.Row_Label_Column}
+	}
+	return nil
+}
+
+// extraLabelValues returns the values of the extra labels of a query, in the order of extraLabelNames.
+// Labels the query doesn't set are empty.
+func extraLabelValues(conf Query) []string {
+	values := make([]string, len(extraLabelNames))
+	for i, name := range extraLabelNames {
+		values[i] = conf.Extra_Labels[name]
+	}
+	return values
+}
+
+// checkExtraLabels returns an error if a query sets an extra label which the result metrics weren't registered with.
+func checkExtraLabels(conf Query) error {
+	for key := range conf.Extra_Labels {
+		i := sort.SearchStrings(extraLabelNames, key)
+		if i == len(extraLabelNames) || extraLabelNames[i] != key {
+			return fmt.Errorf("extra label %s of query %s was not configured at startup, adding extra labels requires a restart", key, conf.Name)
+		}
+	}
+	return nil
+}
+
+// queryMetricName returns the name of the metric a query is exported on.
+func queryMetricName(conf Query) string {
+	if conf.Metric_Name != "" {
+		return conf.Metric_Name
+	}
+
+	name := defaultMetricName
+	if conf.Multi_Column {
+		name = defaultColumnMetricName
+	}
+	if queryMetricType(conf) == metricTypeCounter {
+		name += "_total"
+	}
+	return name
+}
+
+// queryMetricHelp returns the help text of the metric a query is exported on.
+func queryMetricHelp(conf Query) string {
+	if conf.Metric_Help != "" {
+		return conf.Metric_Help
+	}
+	if conf.Metric_Name != "" {
+		return "The result of a specified MySQL query, labeled by query name and SQL statement."
+	}
+	if conf.Multi_Column {
+		return "The cumulative column values returned by specified MySQL multi column counter queries, labeled by query name, SQL statement, row and column name."
+	}
+	return "The cumulative results of specified MySQL counter queries, labeled by query name and SQL statement."
+}
+
+// checkQueryMetric returns the error registerQueryMetric returns for a query because of its own settings,
+// so a reload can be rejected before any running query is stopped.
+func checkQueryMetric(conf Query) error {
+	if err := checkExtraLabels(conf); err != nil {
+		return err
+	}
+	if queryMetricType(conf) == metricTypeSummary {
+		_, err := summaryObjectives(conf)
+		return err
+	}
+	return nil
+}
+
+// registerQueryMetric registers the metric needed by a query, unless it is already registered.
+// These are the dedicated metrics of queries with a metric_name and the shared counter metrics.
+func registerQueryMetric(conf Query) error {
+	// The label names of all result metrics are fixed at startup
+	if err := checkExtraLabels(conf); err != nil {
+		return err
+	}
+
+	// Shared gauges are always registered
+	if conf.Metric_Name == "" && queryMetricType(conf) == metricTypeGauge {
+		return nil
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	name := queryMetricName(conf)
+
+	// Shared counters are registered once, for the first query which uses them
+	if _, ok := customMetrics[name]; ok {
+		return nil
+	}
+
+	var collector prometheus.Collector
+	switch queryMetricType(conf) {
+	case metricTypeCounter:
+		collector = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: name,
+			Help: queryMetricHelp(conf),
+		},
+			queryLabelNames(conf),
+		)
+	case metricTypeSummary:
+		objectives, err := summaryObjectives(conf)
+		if err != nil {
+			return err
+		}
+		collector = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:       name,
+			Help:       queryMetricHelp(conf),
+			Objectives: objectives,
+			MaxAge:     conf.Summary_Max_Age,
+			AgeBuckets: uint32(conf.Summary_Age_Buckets),
+		},
+			queryLabelNames(conf),
+		)
+	case metricTypeHistogram:
+		factor := conf.Native_Histogram_Bucket_Factor
+		if factor == 0 {
+			factor = defaultNativeHistogramBucketFactor
+		}
+		// Without classic buckets the histogram only has native buckets
+		collector = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:                        name,
+			Help:                        queryMetricHelp(conf),
+			NativeHistogramBucketFactor: factor,
+		},
+			queryLabelNames(conf),
+		)
+	default:
+		collector = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: queryMetricHelp(conf),
+		},
+			queryLabelNames(conf),
+		)
+	}
+
+	if err := prometheus.Register(collector); err != nil {
+		return fmt.Errorf("error registering metric %s for query %s: %w", name, conf.Name, err)
+	}
+
+	customMetrics[name] = collector
+
+	return nil
+}
+
+// unregisterUnusedMetrics unregisters the metrics of customMetrics which are not used by any query in queries.
+func unregisterUnusedMetrics(queries []Query) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	used := make(map[string]bool)
+	for _, conf := range queries {
+		used[queryMetricName(conf)] = true
+	}
+
+	for name, collector := range customMetrics {
+		if used[name] {
+			continue
+		}
+		prometheus.Unregister(collector)
+		delete(customMetrics, name)
+	}
+}
+
+// deleteQueryMetrics deletes every series exported for a query, so removed queries don't leave stale series.
+func deleteQueryMetrics(conf Query) {
+	labels := prometheus.Labels{"name": conf.Name}
+
+	metricsMu.RLock()
+	switch vec := customMetrics[queryMetricName(conf)].(type) {
+	case *prometheus.GaugeVec:
+		vec.DeletePartialMatch(labels)
+	case *prometheus.CounterVec:
+		vec.DeletePartialMatch(labels)
+	case *prometheus.SummaryVec:
+		vec.DeletePartialMatch(labels)
+	case *prometheus.HistogramVec:
+		vec.DeletePartialMatch(labels)
+	}
+	metricsMu.RUnlock()
+
+	queryMetric.DeletePartialMatch(labels)
+	queryColumnMetric.DeletePartialMatch(labels)
+	queryDuration.DeletePartialMatch(labels)
+	queryErrors.DeletePartialMatch(labels)
+	queryLastSuccess.DeletePartialMatch(labels)
+	queryTimeouts.DeletePartialMatch(labels)
+	queryJitter.DeletePartialMatch(labels)
+	queryGoroutineActive.DeletePartialMatch(labels)
+	queryPanics.DeletePartialMatch(labels)
+	queryValueClamped.DeletePartialMatch(labels)
+	queryValidationFailures.DeletePartialMatch(labels)
+	queryResultTruncated.DeletePartialMatch(labels)
+	derivedMetrics.forget(conf.Name)
+
+	// Forget the previous counter results of the query
+	prefix := strings.Join([]string{queryMetricName(conf), conf.Name}, "\xff") + "\xff"
+
+	counterMu.Lock()
+	for key := range counterPrevious {
+		if strings.HasPrefix(key, prefix) {
+			delete(counterPrevious, key)
+		}
+	}
+	counterMu.Unlock()
+
+	// The statements of a query are exported under names of their own
+	for _, statement := range statementQueries(conf) {
+		deleteQueryMetrics(statement)
+	}
+}
+
+// summaryObjectives returns the quantile objectives of a summary query, parsed from summary_objectives.
+// The default objectives are used when none are configured.
+func summaryObjectives(conf Query) (map[float64]float64, error) {
+	if len(conf.Summary_Objectives) == 0 {
+		return defaultSummaryObjectives, nil
+	}
+
+	objectives := make(map[float64]float64, len(conf.Summary_Objectives))
+	for quantile, allowedError := range conf.Summary_Objectives {
+		q, err := strconv.ParseFloat(quantile, 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("summary_objectives of query %s has invalid quantile %s, must be between 0 and 1", conf.Name, quantile)
+		}
+		if allowedError < 0 || allowedError > 1 {
+			return nil, fmt.Errorf("summary_objectives of query %s has invalid error %g for quantile %s, must be between 0 and 1", conf.Name, allowedError, quantile)
+		}
+		objectives[q] = allowedError
+	}
+	return objectives, nil
+}
+
+// queryGauge returns the GaugeVec a gauge query's result is exported on.
+func queryGauge(conf Query) *prometheus.GaugeVec {
+	if conf.Metric_Name != "" {
+		metricsMu.RLock()
+		defer metricsMu.RUnlock()
+		return customMetrics[conf.Metric_Name].(*prometheus.GaugeVec)
+	}
+	if conf.Multi_Column {
+		return queryColumnMetric
+	}
+	return queryMetric
+}
+
+// exportQueryResult sends a query result read from the database key to the metric the query is exported on.
+// Gauges are set to the result, counters are increased by the difference to the previous result.
+// labelValues hold the row labels of the result. The name, query and database labels are prepended to them
+// and the extra labels of the query appended. Counters and histograms link the result to the trace in ctx.
+func exportQueryResult(ctx context.Context, key dbKey, conf Query, value float64, labelValues ...string) {
+	// Send the alerts whose condition the result matches
+	if len(conf.Alerts) > 0 {
+		labels := make(map[string]string)
+		for i, name := range resultLabelNames(conf) {
+			labels[name] = labelValues[i]
+		}
+		for name, labelValue := range conf.Extra_Labels {
+			labels[name] = labelValue
+		}
+		queryAlerts.evaluate(key, conf, value, labels)
+	}
+
+	// The name, query and database labels come first, the extra labels last
+	values := []string{conf.Name}
+	if queryLabelEnabled {
+		values = append(values, conf.Query)
+	}
+	if dbLabelsEnabled {
+		values = append(values, key.host(), key.Database)
+	}
+	labelValues = append(append(values, labelValues...), extraLabelValues(conf)...)
+
+	switch queryMetricType(conf) {
+	case metricTypeCounter:
+		name := queryMetricName(conf)
+		metricsMu.RLock()
+		counter := customMetrics[name].(*prometheus.CounterVec).WithLabelValues(labelValues...)
+		metricsMu.RUnlock()
+		addWithExemplar(ctx, counter, counterDelta(name, value, labelValues))
+	case metricTypeSummary:
+		metricsMu.RLock()
+		summary := customMetrics[conf.Metric_Name].(*prometheus.SummaryVec).WithLabelValues(labelValues...)
+		metricsMu.RUnlock()
+		summary.Observe(value)
+	case metricTypeHistogram:
+		metricsMu.RLock()
+		histogram := customMetrics[conf.Metric_Name].(*prometheus.HistogramVec).WithLabelValues(labelValues...)
+		metricsMu.RUnlock()
+		observeWithExemplar(ctx, histogram, value)
+	default:
+		queryGauge(conf).WithLabelValues(labelValues...).Set(value)
+	}
+}
+
+// counterDelta returns how much a counter series has to be increased for a new result and stores the result.
+// The first result is added in full. A result lower than the previous one means the source was reset, so it is added in full too.
+func counterDelta(name string, value float64, labelValues []string) float64 {
+	key := strings.Join(append([]string{name}, labelValues...), "\xff")
+
+	counterMu.Lock()
+	defer counterMu.Unlock()
+
+	previous, ok := counterPrevious[key]
+	counterPrevious[key] = value
+
+	if !ok || value < previous {
+		return value
+	}
+	return value - previous
+}
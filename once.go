@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// runOnce runs every query of config once, one after the other in the order of their depends_on,
+// and prints their results to out in key=value form. Failed queries are logged. It reports whether all queries succeeded.
+func runOnce(ctx context.Context, config Config, out io.Writer) bool {
+	dbs := make(map[dbKey]*sql.DB)
+	defer closeDatabases(dbs)
+
+	// The config has been validated, so the dependencies have no cycle
+	queries, _ := dependencyOrder(config.Queries)
+
+	ok := true
+	for _, conf := range queries {
+		logger := queryLogger(conf)
+
+		// Open one connection pool per database, shared by the queries running on it
+		key := queryDBKey(config, conf)
+		db, opened := dbs[key]
+		if !opened {
+			dbConfig, err := queryDBConfig(config, conf)
+			if err == nil {
+				db, err = openDatabase(conf.Connection, dbConfig)
+			}
+			if err != nil {
+				logger.Error("Query failed", "error", err)
+				ok = false
+				continue
+			}
+			dbs[key] = db
+		}
+
+		if err := registerQueryMetric(conf); err != nil {
+			logger.Error("Query failed", "error", err)
+			ok = false
+			continue
+		}
+
+		// The results are collected by queryStatuses, like for the status page
+		queryStatuses.track(conf, key.String(), time.Time{})
+		queryStatuses.started(conf.Name)
+		logger.Debug("Running query", "query", conf.Query)
+		err := sanitizePoolError(db, runQuery(ctx, db, key, conf))
+		queryStatuses.finished(conf.Name, err, time.Time{})
+
+		if err != nil {
+			logger.Error("Query failed", "error", err)
+			ok = false
+			continue
+		}
+
+		for _, state := range queryStatuses.snapshot() {
+			if state.Name != conf.Name {
+				continue
+			}
+			for _, result := range state.LastResults {
+				fmt.Fprintln(out, result)
+			}
+		}
+	}
+
+	return ok
+}
+
+// testQuery runs the query of config named name once and prints its results and execution time to out.
+// When no query has that name the names of the configured queries are printed instead.
+// It reports whether the query succeeded.
+func testQuery(ctx context.Context, config Config, name string, out io.Writer) bool {
+	names := make([]string, 0, len(config.Queries))
+	for _, conf := range config.Queries {
+		if conf.Name != name {
+			names = append(names, conf.Name)
+			continue
+		}
+
+		config.Queries = []Query{conf}
+		start := time.Now()
+		ok := runOnce(ctx, config, out)
+		fmt.Fprintf(out, "Query %s took %s\n", name, time.Since(start).Round(time.Millisecond))
+		return ok
+	}
+
+	fmt.Fprintf(out, "Query %s not found, available queries: %s\n", name, strings.Join(names, ", "))
+	return false
+}
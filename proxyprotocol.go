@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Network the dialer sending the PROXY protocol header is registered under in the MySQL driver
+const proxyProtocolNet = "tcp+proxy"
+
+func init() {
+	mysql.RegisterDialContext(proxyProtocolNet, dialProxyProtocol)
+}
+
+// dialProxyProtocol connects to addr over TCP and sends a PROXY protocol v1 header before the MySQL handshake,
+// so proxies such as ProxySQL and HAProxy pass the address of the exporter on to the server.
+func dialProxyProtocol(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The header must be written before the server sends its greeting, so it honours the dial deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte(proxyProtocolHeader(conn.LocalAddr(), conn.RemoteAddr()))); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending PROXY protocol header to %s: %w", addr, err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyProtocolHeader returns the PROXY protocol v1 header of a connection from source to destination.
+// Addresses which aren't TCP are sent as UNKNOWN, which tells the proxy to use the connection's own addresses.
+func proxyProtocolHeader(source net.Addr, destination net.Addr) string {
+	src, srcOK := source.(*net.TCPAddr)
+	dst, dstOK := destination.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	family := "TCP6"
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port)
+}
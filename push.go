@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Supported values of the mode config field
+const (
+	modePull = "pull"
+	modePush = "push"
+	modeBoth = "both"
+)
+
+// Job name the metrics are pushed under when push_job_name is not configured
+const defaultPushJobName = "mysql_query_exporter"
+
+// Pusher sending the metrics to the Pushgateway, nil when pushing is disabled.
+// Guarded by pushMu so concurrent query goroutines push one at a time.
+var (
+	pushMu sync.Mutex
+	pusher *push.Pusher
+)
+
+// configMode returns the mode of config, defaulting to pull.
+func configMode(config Config) string {
+	if config.Mode == "" {
+		return modePull
+	}
+	return config.Mode
+}
+
+// setupPush creates the Pushgateway pusher when the mode is push or both.
+func setupPush(config Config) {
+	mode := configMode(config)
+	if mode != modePush && mode != modeBoth {
+		return
+	}
+
+	job := config.Push_Job_Name
+	if job == "" {
+		job = defaultPushJobName
+	}
+
+	pushMu.Lock()
+	defer pushMu.Unlock()
+
+	pusher = push.New(config.Push_Gateway_URL, job).Gatherer(metricsGatherer)
+}
+
+// pushMetrics pushes all metrics to the Pushgateway. It does nothing when pushing is disabled.
+func pushMetrics() {
+	pushMu.Lock()
+	defer pushMu.Unlock()
+
+	if pusher == nil {
+		return
+	}
+
+	if err := pusher.Push(); err != nil {
+		slog.Error("Error pushing metrics to the Pushgateway", "error", err)
+	}
+}
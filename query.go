@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backoff before the first retry of a failed query when retry_backoff is not configured
+const defaultRetryBackoff = time.Second
+
+// Maximum number of rows read from a result set when max_query_results is not configured
+const defaultMaxQueryResults = 1000
+
+// queryer is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// queryError is an error returned while running a query, with the error_type label value it is counted under.
+type queryError struct {
+	errorType string
+	err       error
+}
+
+func (e *queryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *queryError) Unwrap() error {
+	return e.err
+}
+
+// newQueryError wraps err in a queryError of the given type, adding a description of what failed.
+func newQueryError(errorType string, err error, format string, args ...any) *queryError {
+	return &queryError{errorType: errorType, err: fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), err)}
+}
+
+// retryable reports whether a query which failed with err may succeed when retried.
+// Connection and query errors are transient, scan errors mean the result can't be read and won't go away.
+func retryable(err error) bool {
+	var qerr *queryError
+	return errors.As(err, &qerr) && qerr.errorType != queryErrorScan
+}
+
+// checkQuery runs a query on an already open database connection and sends the results to Prometheus.
+// Failed attempts are retried up to retry_count times with exponential backoff.
+// It uses the provided context to support cancellation.
+
+func checkQuery(ctx context.Context, db *sql.DB, key dbKey, conf Query) {
+	// Log that the function is running the provided query
+	logger := queryLogger(conf)
+	logger.Debug("Running query", "query", conf.Query)
+
+	backoff := conf.Retry_Backoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	// Record the run on the status page
+	queryStatuses.started(conf.Name)
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		// Run the query and send its result and duration to Prometheus
+		err = runQuery(ctx, db, key, conf)
+
+		if err == nil {
+			// Log that the query completed successfully
+			logger.Debug("Query complete")
+
+			// Record that the query succeeded
+			recordQuerySuccess(conf)
+			break
+		}
+
+		// If there was an error running the query, log it
+		logger.Error("Query failed", "error", sanitizePoolError(db, err))
+
+		// Count the error once all retries are exhausted
+		if attempt >= conf.Retry_Count || !retryable(err) || ctx.Err() != nil {
+			var qerr *queryError
+			if errors.As(err, &qerr) {
+				recordQueryError(conf, qerr.errorType)
+			}
+			break
+		}
+
+		// Wait before retrying, doubling the backoff after every attempt
+		logger.Warn("Retrying query", "backoff", backoff.String(), "retry", attempt+1, "retry_count", conf.Retry_Count)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+	}
+
+	// Record the outcome of the run and when the query runs next on the status page
+	queryStatuses.finished(conf.Name, sanitizePoolError(db, err), time.Now().Add(conf.Interval))
+
+	// Push the results when a Pushgateway is configured
+	pushMetrics()
+}
+
+// runQuery runs a single attempt of a query on the database key. Getting a connection from the pool is bounded
+// by connection_timeout and running the query by query_timeout.
+// Executions exceeding the query timeout are counted in mysql_query_timeout_total.
+// Every attempt is traced in a span when otel_endpoint is set.
+func runQuery(ctx context.Context, db *sql.DB, key dbKey, conf Query) (err error) {
+	// Record the start time to measure the query duration
+	start := time.Now()
+
+	ctx, span := startQuerySpan(ctx, key, conf)
+	defer func() {
+		// Send the query duration to Prometheus, whether the query succeeded or not, linked to the trace of the attempt
+		observeWithExemplar(ctx, queryDuration.WithLabelValues(conf.Name), time.Since(start).Seconds())
+		endQuerySpan(span, sanitizePoolError(db, err))
+	}()
+
+	// Bound getting a connection by the configured connection timeout, if any
+	connCtx := ctx
+	if conf.Connection_Timeout > 0 {
+		var connCancel context.CancelFunc
+		connCtx, connCancel = context.WithTimeout(ctx, conf.Connection_Timeout)
+		defer connCancel()
+	}
+
+	conn, err := db.Conn(connCtx)
+	if err != nil {
+		return newQueryError(queryErrorConnection, err, "error connecting to database for query %s", conf.Query)
+	}
+
+	// Return the connection to the pool when the function returns
+	defer conn.Close()
+
+	// Bound the query execution by the configured timeout, if any
+	queryCtx := ctx
+	if timeout := queryTimeout(conf); timeout > 0 {
+		var queryCancel context.CancelFunc
+		queryCtx, queryCancel = context.WithTimeout(ctx, timeout)
+		defer queryCancel()
+	}
+
+	// Set up the session of the connection, the query runs on the same connection so it sees the settings
+	if conf.Pre_Query != "" {
+		queryLogger(conf).Debug("Running pre_query", "pre_query", conf.Pre_Query)
+		// The settings would leak into the other queries using the connection, so it is closed rather than
+		// returned to the pool. Deferred calls run last in first out, so this runs before conn.Close.
+		defer conn.Raw(func(any) error { return driver.ErrBadConn })
+		if _, err := conn.ExecContext(queryCtx, conf.Pre_Query); err != nil {
+			return newQueryError(queryErrorType(err), err, "error executing pre_query %s of query %s", conf.Pre_Query, conf.Query)
+		}
+	}
+
+	// Consistent reads and statements run in a read-only transaction, committed once the results were read
+	var q queryer = conn
+	var tx *sql.Tx
+	if conf.Consistent_Read || len(conf.Statements) > 0 {
+		tx, err = conn.BeginTx(queryCtx, &sql.TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+		if err != nil {
+			return newQueryError(queryErrorType(err), err, "error starting transaction for query %s", conf.Query)
+		}
+		q = tx
+	}
+
+	switch {
+	case len(conf.Statements) > 0:
+		err = runStatements(queryCtx, q, key, conf)
+	case conf.Multi_Column:
+		err = runMultiColumnQuery(queryCtx, q, key, conf)
+	case conf.Multi_Row:
+		err = runMultiRowQuery(queryCtx, q, key, conf)
+	default:
+		err = runCountQuery(queryCtx, q, key, conf)
+	}
+
+	if tx != nil {
+		if err != nil {
+			tx.Rollback()
+		} else if commitErr := tx.Commit(); commitErr != nil {
+			err = newQueryError(queryErrorType(commitErr), commitErr, "error committing transaction of query %s", conf.Query)
+		}
+	}
+
+	// Count the executions cancelled by the query timeout, but not those cancelled by the exporter shutting down
+	if errors.Is(err, context.DeadlineExceeded) && queryCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		queryTimeouts.WithLabelValues(conf.Name).Inc()
+	}
+
+	return err
+}
+
+// queryTimeout returns the maximum duration of a single execution of a query, set by query_timeout or its alias timeout.
+func queryTimeout(conf Query) time.Duration {
+	if conf.Query_Timeout > 0 {
+		return conf.Query_Timeout
+	}
+	return conf.Timeout
+}
+
+// runCountQuery runs a query returning a single count on the database key and sends it to Prometheus.
+func runCountQuery(ctx context.Context, q queryer, key dbKey, conf Query) error {
+	return runCount(ctx, q, key, conf, conf.Name)
+}
+
+// runCount runs the SQL of conf, which returns a single count, and sends the count to Prometheus.
+// The count is shown on the status page under statusName, the name of the query the statements of conf belong to.
+func runCount(ctx context.Context, q queryer, key dbKey, conf Query, statusName string) error {
+	// Declare a variable to store the result, NULL results like AVG on an empty table are scanned as nil
+	var count *float64
+
+	// Run the query
+	rows, err := q.QueryContext(ctx, commentedQuery(conf))
+	if err != nil {
+		return newQueryError(queryErrorType(err), err, "error executing query %s", conf.Query)
+	}
+
+	// Ensure the result set is closed when the function returns
+	defer rows.Close()
+
+	// A count query must return a row
+	if !rows.Next() {
+		err := rows.Err()
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return newQueryError(queryErrorType(err), err, "error executing query %s", conf.Query)
+	}
+
+	// Store the result in the count variable
+	if err := rows.Scan(&count); err != nil {
+		return newQueryError(queryErrorScan, err, "error scanning result of query %s", conf.Query)
+	}
+
+	// NULL results are exported as the null_value of the query, other results are transformed and clamped
+	result := conf.Null_Value
+	if count != nil {
+		result = transformResult(conf, *count)
+		if !expectedResult(conf, result) {
+			return nil
+		}
+		result = clampResult(conf, result)
+	}
+
+	// Log the query result
+	queryLogger(conf).Debug("Query result", "value", result)
+	queryStatuses.result(statusName, formatResult(conf, result))
+
+	// Send the query result to Prometheus and keep it for the derived metrics
+	exportQueryResult(ctx, key, conf, result)
+	derivedMetrics.record(conf.Name, result)
+
+	return nil
+}
+
+// runStatements runs the statements of a query one after the other in the transaction q. The count returned by
+// every statement reading rows is sent to Prometheus under the name of the query followed by the statement index,
+// such as orders_1. Other statements, such as SET @cutoff = NOW() - INTERVAL 1 HOUR, prepare the following ones.
+func runStatements(ctx context.Context, q queryer, key dbKey, conf Query) error {
+	for _, statement := range statementQueries(conf) {
+		if readStatement(statement.Query) {
+			if err := runCount(ctx, q, key, statement, conf.Name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := q.ExecContext(ctx, commentedQuery(statement)); err != nil {
+			return newQueryError(queryErrorType(err), err, "error executing statement %s", statement.Query)
+		}
+	}
+	return nil
+}
+
+// statementQueries returns the statements of a query as queries of their own, named after the query followed by
+// the index of the statement. They share every other setting of the query.
+func statementQueries(conf Query) []Query {
+	queries := make([]Query, len(conf.Statements))
+	for i, statement := range conf.Statements {
+		queries[i] = conf
+		queries[i].Name = fmt.Sprintf("%s_%d", conf.Name, i)
+		queries[i].Query = statement
+		queries[i].Statements = nil
+	}
+	return queries
+}
+
+// runMultiColumnQuery runs a query returning any number of rows and columns and sends every value to Prometheus.
+// The first column of each row is used as the row label, every other column is exported with its column name as label.
+// Values which are not numeric are skipped and reported as a scan error once all rows were read.
+func runMultiColumnQuery(ctx context.Context, q queryer, key dbKey, conf Query) error {
+	// Run the query
+	rows, err := q.QueryContext(ctx, commentedQuery(conf))
+	if err != nil {
+		return newQueryError(queryErrorType(err), err, "error executing query %s", conf.Query)
+	}
+
+	// Ensure the result set is closed when the function returns
+	defer rows.Close()
+
+	// Read the column names, which are used as label values
+	columns, err := rows.Columns()
+	if err != nil {
+		return newQueryError(queryErrorScan, err, "error reading columns of query %s", conf.Query)
+	}
+
+	// Multi column queries need a row label column and at least one value column
+	if len(columns) < 2 {
+		return newQueryError(queryErrorScan, fmt.Errorf("got %d columns", len(columns)), "multi column query %s must return at least 2 columns", conf.Query)
+	}
+
+	// Scan every column as a nullable string so both labels and values can be read
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	// First value which could not be parsed, reported after all other values were exported
+	var parseErr error
+
+	for read := 0; rows.Next(); read++ {
+		if read == maxQueryResults(conf) {
+			truncateResults(conf, rows)
+			break
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return newQueryError(queryErrorScan, err, "error scanning result of query %s", conf.Query)
+		}
+
+		row := values[0].String
+
+		for i, column := range columns[1:] {
+			value := values[i+1]
+
+			// NULL values are exported as the null_value of the query
+			result := conf.Null_Value
+			if value.Valid {
+				result, err = strconv.ParseFloat(value.String, 64)
+				if err != nil {
+					if parseErr == nil {
+						parseErr = newQueryError(queryErrorScan, err, "column %s of query %s is not numeric", column, conf.Query)
+					}
+					continue
+				}
+				result = transformResult(conf, result)
+				if !expectedResult(conf, result) {
+					continue
+				}
+				result = clampResult(conf, result)
+			}
+
+			// Log the query result
+			queryLogger(conf).Debug("Query result", "row", row, "column", column, "value", result)
+			queryStatuses.result(conf.Name, formatResult(conf, result, "row", row, "column", column))
+
+			// Send the value to Prometheus
+			exportQueryResult(ctx, key, conf, result, row, column)
+		}
+	}
+
+	// If there was an error iterating the result set, return it
+	if err := rows.Err(); err != nil {
+		return newQueryError(queryErrorType(err), err, "error reading result of query %s", conf.Query)
+	}
+
+	return parseErr
+}
+
+// runMultiRowQuery runs a query returning a label and a value column and sends the value of every row to Prometheus.
+// The first column of each row is exported as the row_label_column label, the second column as the value.
+// Values which are not numeric are skipped and reported as a scan error once all rows were read.
+func runMultiRowQuery(ctx context.Context, q queryer, key dbKey, conf Query) error {
+	// Run the query
+	rows, err := q.QueryContext(ctx, commentedQuery(conf))
+	if err != nil {
+		return newQueryError(queryErrorType(err), err, "error executing query %s", conf.Query)
+	}
+
+	// Ensure the result set is closed when the function returns
+	defer rows.Close()
+
+	// Multi row queries need exactly a label column and a value column
+	columns, err := rows.Columns()
+	if err != nil {
+		return newQueryError(queryErrorScan, err, "error reading columns of query %s", conf.Query)
+	}
+	if len(columns) != 2 {
+		return newQueryError(queryErrorScan, fmt.Errorf("got %d columns", len(columns)), "multi row query %s must return 2 columns", conf.Query)
+	}
+
+	// First value which could not be parsed, reported after all other values were exported
+	var parseErr error
+
+	for read := 0; rows.Next(); read++ {
+		if read == maxQueryResults(conf) {
+			truncateResults(conf, rows)
+			break
+		}
+
+		var label, value sql.NullString
+		if err := rows.Scan(&label, &value); err != nil {
+			return newQueryError(queryErrorScan, err, "error scanning result of query %s", conf.Query)
+		}
+
+		// NULL values are exported as the null_value of the query
+		result := conf.Null_Value
+		if value.Valid {
+			result, err = strconv.ParseFloat(value.String, 64)
+			if err != nil {
+				if parseErr == nil {
+					parseErr = newQueryError(queryErrorScan, err, "value of row %s of query %s is not numeric", label.String, conf.Query)
+				}
+				continue
+			}
+			result = transformResult(conf, result)
+			if !expectedResult(conf, result) {
+				continue
+			}
+			result = clampResult(conf, result)
+		}
+
+		// Log the query result
+		queryLogger(conf).Debug("Query result", conf.Row_Label_Column, label.String, "value", result)
+		queryStatuses.result(conf.Name, formatResult(conf, result, conf.Row_Label_Column, label.String))
+
+		// Send the value to Prometheus
+		exportQueryResult(ctx, key, conf, result, label.String)
+	}
+
+	// If there was an error iterating the result set, return it
+	if err := rows.Err(); err != nil {
+		return newQueryError(queryErrorType(err), err, "error reading result of query %s", conf.Query)
+	}
+
+	return parseErr
+}
+
+// maxQueryResults returns the maximum number of rows read from the result set of a query, set by max_query_results.
+func maxQueryResults(conf Query) int {
+	if conf.Max_Query_Results > 0 {
+		return conf.Max_Query_Results
+	}
+	return defaultMaxQueryResults
+}
+
+// truncateResults closes the result set of a query returning more than max_query_results rows, so a query
+// missing its WHERE clause can't exhaust the memory of the exporter. The truncation is logged and counted.
+func truncateResults(conf Query, rows *sql.Rows) {
+	rows.Close()
+	queryLogger(conf).Warn("Query returned more rows than max_query_results, skipping the remaining rows", "max_query_results", maxQueryResults(conf))
+	queryResultTruncated.WithLabelValues(conf.Name).Inc()
+}
+
+// formatResult formats a query result in key=value form, the key being the query name followed by the
+// labels telling apart the rows and columns of the result, given as alternating names and values.
+// For example orders{row="paid",column="total"}=3.
+func formatResult(conf Query, value float64, labels ...string) string {
+	var key strings.Builder
+	key.WriteString(conf.Name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			key.WriteString("{")
+		} else {
+			key.WriteString(",")
+		}
+		fmt.Fprintf(&key, "%s=%q", labels[i], labels[i+1])
+	}
+	if len(labels) > 1 {
+		key.WriteString("}")
+	}
+	return key.String() + "=" + strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// openTestDatabase opens an in-memory SQLite database closed at the end of the test.
+func openTestDatabase(t testing.TB) (*sql.DB, dbKey) {
+	t.Helper()
+	dbConfig := DBConfig{Type: dbTypeSQLite, Host: ":memory:"}
+	db, err := openDatabase("", dbConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a separate database, so tables must stay on one connection
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db, dbKey{Type: dbTypeSQLite, Host: dbConfig.Host}
+}
+
+func TestCheckQueryNextRunIsOneIntervalAway(t *testing.T) {
+	db, key := openTestDatabase(t)
+	conf := Query{Name: "interval_regression", Query: "SELECT 1", Interval: 5 * time.Second}
+	queryStatuses.track(conf, key.String(), time.Time{})
+	t.Cleanup(func() { queryStatuses.forget(conf.Name) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(done)
+		checkQuery(ctx, db, key, conf)
+	}()
+
+	// The next run is scheduled once the run finished
+	var state queryState
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, s := range queryStatuses.snapshot() {
+			if s.Name == conf.Name {
+				state = s
+			}
+		}
+		if !state.NextRun.IsZero() {
+			break
+		}
+	}
+	cancel()
+	<-done
+
+	if state.LastError != "" {
+		t.Fatalf("query failed: %s", state.LastError)
+	}
+	// A 5s interval multiplied by time.Second would schedule the next run 158 years away
+	wait := state.NextRun.Sub(start)
+	if wait < 5*time.Second || wait > 6*time.Second {
+		t.Errorf("next run in %s, want 5s", wait)
+	}
+}
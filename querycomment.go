@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Host and process running the exporter, named in the query comments to tell apart the exporters of a multi-host deployment
+var (
+	queryCommentHost, _ = os.Hostname()
+	queryCommentPID     = os.Getpid()
+)
+
+// Whether add_query_comment was set to false, updated on every config (re)load
+var queryCommentDisabled atomic.Bool
+
+// setQueryComment enables or disables the query comments as set by add_query_comment, which defaults to true.
+func setQueryComment(config Config) {
+	queryCommentDisabled.Store(config.Add_Query_Comment != nil && !*config.Add_Query_Comment)
+}
+
+// commentedQuery returns the SQL of a query as sent to the database, prefixed with a comment naming the query,
+// host and process of the exporter, so DBAs can find the exporter's queries in the slow query log and PROCESSLIST.
+func commentedQuery(conf Query) string {
+	if queryCommentDisabled.Load() {
+		return conf.Query
+	}
+	return fmt.Sprintf("/* mysql_query_exporter name=%s host=%s pid=%d */ %s", commentSafe(conf.Name), commentSafe(queryCommentHost), queryCommentPID, conf.Query)
+}
+
+// commentSafe breaks up */ in a value written into a comment, which would otherwise end the comment early.
+func commentSafe(value string) string {
+	return strings.ReplaceAll(value, "*/", "* /")
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// Supported relabelling actions, with the same meaning as in Prometheus' metric_relabel_configs
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelKeep = "labelkeep"
+	relabelLabelMap  = "labelmap"
+)
+
+// Label holding the metric name while relabelling
+const metricNameLabel = "__name__"
+
+// Struct for entries of the metric_relabel_configs list in yaml file
+type RelabelConfig struct {
+	// Labels whose values are joined with separator (default ;) and matched against regex
+	Source_Labels []string `yaml:"source_labels" json:"source_labels" toml:"source_labels"`
+	Separator     string   `yaml:"separator" json:"separator" toml:"separator"`
+	// Label set to replacement by the replace action
+	Target_Label string `yaml:"target_label" json:"target_label" toml:"target_label"`
+	// Regular expression, anchored at both ends. Defaults to (.*).
+	Regex string `yaml:"regex" json:"regex" toml:"regex"`
+	// Value of the target label of the replace action, may reference regex groups. Defaults to $1.
+	Replacement string `yaml:"replacement" json:"replacement" toml:"replacement"`
+	// One of replace (default), keep, drop, labeldrop, labelkeep or labelmap
+	Action string `yaml:"action" json:"action" toml:"action"`
+}
+
+// relabelRule is a RelabelConfig with its defaults applied and its regex compiled.
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	targetLabel  string
+	regex        *regexp.Regexp
+	replacement  string
+	action       string
+}
+
+// compileRelabelConfigs validates configs and compiles them into relabelling rules.
+func compileRelabelConfigs(configs []RelabelConfig) ([]relabelRule, error) {
+	rules := make([]relabelRule, 0, len(configs))
+	for i, config := range configs {
+		rule := relabelRule{
+			sourceLabels: config.Source_Labels,
+			separator:    config.Separator,
+			targetLabel:  config.Target_Label,
+			replacement:  config.Replacement,
+			action:       strings.ToLower(config.Action),
+		}
+		if rule.separator == "" {
+			rule.separator = ";"
+		}
+		if rule.replacement == "" {
+			rule.replacement = "$1"
+		}
+		if rule.action == "" {
+			rule.action = relabelReplace
+		}
+
+		expr := config.Regex
+		if expr == "" {
+			expr = "(.*)"
+		}
+		regex, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("metric_relabel_configs[%d]: invalid regex %s: %w", i, config.Regex, err)
+		}
+		rule.regex = regex
+
+		switch rule.action {
+		case relabelReplace:
+			if rule.targetLabel == "" {
+				return nil, fmt.Errorf("metric_relabel_configs[%d]: target_label is required for action %s", i, rule.action)
+			}
+		case relabelKeep, relabelDrop:
+			if len(rule.sourceLabels) == 0 {
+				return nil, fmt.Errorf("metric_relabel_configs[%d]: source_labels is required for action %s", i, rule.action)
+			}
+		case relabelLabelDrop, relabelLabelKeep, relabelLabelMap:
+		default:
+			return nil, fmt.Errorf("metric_relabel_configs[%d]: unknown action %s", i, config.Action)
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// apply relabels the labels of a metric, including its name in __name__.
+// It returns false when the metric is dropped.
+func (rule relabelRule) apply(labels map[string]string) bool {
+	values := make([]string, len(rule.sourceLabels))
+	for i, name := range rule.sourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, rule.separator)
+
+	switch rule.action {
+	case relabelReplace:
+		match := rule.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		target := string(rule.regex.ExpandString(nil, rule.targetLabel, value, match))
+		replaced := string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+		if replaced == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = replaced
+		}
+	case relabelKeep:
+		return rule.regex.MatchString(value)
+	case relabelDrop:
+		return !rule.regex.MatchString(value)
+	case relabelLabelDrop, relabelLabelKeep:
+		for name := range labels {
+			if name == metricNameLabel {
+				continue
+			}
+			if rule.regex.MatchString(name) == (rule.action == relabelLabelDrop) {
+				delete(labels, name)
+			}
+		}
+	case relabelLabelMap:
+		for name, labelValue := range labels {
+			if rule.regex.MatchString(name) {
+				labels[rule.regex.ReplaceAllString(name, rule.replacement)] = labelValue
+			}
+		}
+	}
+	return true
+}
+
+// relabelGatherer applies the metric_relabel_configs to the metrics gathered from a registry,
+// so they are exposed relabelled on /metrics and pushed relabelled to the Pushgateway.
+type relabelGatherer struct {
+	gatherer prometheus.Gatherer
+
+	mu    sync.RWMutex
+	rules []relabelRule
+}
+
+// Gatherer of the exposed metrics, relabelled with the metric_relabel_configs of the config
+var metricsGatherer = &relabelGatherer{gatherer: prometheus.DefaultGatherer}
+
+// setRules replaces the relabelling rules, which are applied from the next gather on.
+func (g *relabelGatherer) setRules(rules []relabelRule) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.rules = rules
+}
+
+// setRelabelConfigs applies the metric_relabel_configs of config to the exposed metrics, on /metrics and the listen_addresses.
+// The config must have been validated, invalid rules are logged and ignored.
+func setRelabelConfigs(config Config) {
+	rules, err := compileRelabelConfigs(config.Metric_Relabel_Configs)
+	if err != nil {
+		slog.Error("Error compiling metric_relabel_configs, metrics are not relabelled", "error", err)
+	}
+	metricsGatherer.setRules(rules)
+
+	listenGatherersMu.Lock()
+	defer listenGatherersMu.Unlock()
+	for _, gatherer := range listenGatherers {
+		gatherer.setRules(rules)
+	}
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+
+	g.mu.RLock()
+	rules := g.rules
+	g.mu.RUnlock()
+
+	if len(rules) == 0 {
+		return families, err
+	}
+
+	// Metrics are regrouped by name, as relabelling may rename them
+	relabelled := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			labels := map[string]string{metricNameLabel: family.GetName()}
+			for _, pair := range metric.Label {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+
+			kept := true
+			for _, rule := range rules {
+				if kept = rule.apply(labels); !kept {
+					break
+				}
+			}
+			name := labels[metricNameLabel]
+			if !kept || !model.IsValidMetricName(model.LabelValue(name)) {
+				continue
+			}
+
+			target, ok := relabelled[name]
+			if !ok {
+				target = &dto.MetricFamily{Name: &name, Help: family.Help, Type: family.Type}
+				relabelled[name] = target
+			}
+			target.Metric = append(target.Metric, relabelMetric(metric, labels))
+		}
+	}
+
+	result := make([]*dto.MetricFamily, 0, len(relabelled))
+	for _, family := range relabelled {
+		result = append(result, family)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result, err
+}
+
+// relabelMetric returns a copy of metric with its labels replaced by the relabelled labels.
+// Labels starting with __ are only used while relabelling and are removed.
+func relabelMetric(metric *dto.Metric, labels map[string]string) *dto.Metric {
+	copied := &dto.Metric{
+		Gauge:       metric.Gauge,
+		Counter:     metric.Counter,
+		Summary:     metric.Summary,
+		Untyped:     metric.Untyped,
+		Histogram:   metric.Histogram,
+		TimestampMs: metric.TimestampMs,
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !strings.HasPrefix(name, "__") && model.LabelName(name).IsValid() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		name, value := name, labels[name]
+		copied.Label = append(copied.Label, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	return copied
+}
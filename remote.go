@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeout of the HTTP requests fetching a remote config
+const configFetchTimeout = 30 * time.Second
+
+// Client used to fetch remote configs
+var configClient = &http.Client{Timeout: configFetchTimeout}
+
+// isConfigURL reports whether the config location is an http:// or https:// URL rather than a file path.
+func isConfigURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// fetchConfig fetches the config from url, sending authToken as bearer token when it is set.
+// When format is empty it is detected from the Content-Type of the response, defaulting to YAML.
+func fetchConfig(url string, format string, authToken string) (Config, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return Config{}, err
+	}
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	resp, err := configClient.Do(req)
+	if err != nil {
+		return Config{}, fmt.Errorf("error fetching config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Config{}, fmt.Errorf("error fetching config: unexpected status %s", resp.Status)
+	}
+
+	bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Config{}, fmt.Errorf("error reading config response: %w", err)
+	}
+
+	if format == "" {
+		format = configFormatFromContentType(resp.Header.Get("Content-Type"))
+	}
+
+	return decodeConfig(bytes, format)
+}
+
+// configFormatFromContentType returns the config format matching a Content-Type header, defaulting to YAML.
+func configFormatFromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return configFormatYAML
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return configFormatJSON
+	case mediaType == "application/toml":
+		return configFormatTOML
+	default:
+		return configFormatYAML
+	}
+}
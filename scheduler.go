@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math/big"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Delay before a query loop which panicked is restarted
+const panicRestartDelay = 10 * time.Second
+
+// scheduler runs one goroutine per configured query and applies config reloads.
+type scheduler struct {
+	// Parent context of every query goroutine
+	ctx context.Context
+
+	mu sync.Mutex
+	// Open connection pools, keyed by dbKey
+	dbs map[dbKey]*sql.DB
+	// Running query goroutines, keyed by query name
+	running map[string]*runningQuery
+	// Goroutines pinging the connection pools, stopped by cancelling pingCancel
+	pingCancel context.CancelFunc
+	pingDone   chan struct{}
+}
+
+// runningQuery is a query goroutine started by the scheduler.
+type runningQuery struct {
+	conf   Query
+	db     *sql.DB
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newScheduler returns a scheduler whose query goroutines stop when ctx is cancelled.
+func newScheduler(ctx context.Context) *scheduler {
+	return &scheduler{
+		ctx:     ctx,
+		dbs:     make(map[dbKey]*sql.DB),
+		running: make(map[string]*runningQuery),
+	}
+}
+
+// partialApplyError is returned by apply when config was applied except for the queries whose metric
+// couldn't be registered, which are not running.
+type partialApplyError struct {
+	errs []error
+}
+
+func (e *partialApplyError) Error() string {
+	return errors.Join(e.errs...).Error()
+}
+
+func (e *partialApplyError) Unwrap() []error {
+	return e.errs
+}
+
+// apply makes the running queries match config. Queries which were removed or changed are stopped
+// and their metrics deleted, queries which were added or changed are started, unchanged queries keep running.
+// Connection pools are reused as long as their DSN is unchanged.
+// When a connection pool can't be opened or the metric settings of a query to start are invalid, nothing is
+// changed and the error is returned. Queries whose metric fails to register with Prometheus are only found out
+// once the changed queries are stopped, they are skipped and reported in a *partialApplyError.
+func (s *scheduler) apply(config Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Open the connection pools needed by the config, reusing the pools whose DSN is unchanged.
+	// The dbKey holds a hash of the DSN, so changed credentials and settings open a new pool.
+	dbs := make(map[dbKey]*sql.DB)
+	opened := make(map[dbKey]*sql.DB)
+
+	for _, conf := range config.Queries {
+		key := queryDBKey(config, conf)
+
+		// Skip databases which already have an open connection pool
+		if _, ok := dbs[key]; ok {
+			continue
+		}
+
+		dbConfig, err := queryDBConfig(config, conf)
+		if err == nil {
+			if db, ok := s.dbs[key]; ok {
+				// Reused pools pick up changed pool settings
+				applyPoolSettings(db, dbConfig)
+				dbs[key] = db
+				continue
+			}
+
+			var db *sql.DB
+			if db, err = openDatabase(conf.Connection, dbConfig); err == nil {
+				dbs[key] = db
+				opened[key] = db
+				continue
+			}
+		}
+
+		// Close the connection pools opened so far and keep the current config
+		closeDatabases(opened)
+		return err
+	}
+
+	// Find the queries which were removed or changed, including queries whose connection pool changed
+	queries := make(map[string]Query)
+	for _, conf := range config.Queries {
+		queries[conf.Name] = conf
+	}
+
+	stopping := make(map[string]bool)
+	for name, running := range s.running {
+		conf, ok := queries[name]
+		if !ok || !reflect.DeepEqual(conf, running.conf) || dbs[queryDBKey(config, conf)] != running.db {
+			stopping[name] = true
+		}
+	}
+
+	// Check the metric settings of the queries to start before stopping any query, so an invalid config keeps
+	// the current queries running
+	var errs []error
+	for _, conf := range config.Queries {
+		if _, ok := s.running[conf.Name]; ok && !stopping[conf.Name] {
+			continue
+		}
+		if err := checkQueryMetric(conf); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		closeDatabases(opened)
+		return errors.Join(errs...)
+	}
+
+	// Stop the queries which were removed or changed. Removed queries are no longer waited for by /ready,
+	// changed queries keep their readiness, so a reload doesn't take the exporter out of service.
+	for name := range stopping {
+		running := s.running[name]
+		queryLogger(running.conf).Info("Stopping query")
+		running.cancel()
+		<-running.done
+
+		deleteQueryMetrics(running.conf)
+		if _, ok := queries[name]; !ok {
+			queryReadiness.succeeded(name)
+		}
+		queryStatuses.forget(name)
+		queryAlerts.forget(name)
+		delete(s.running, name)
+	}
+
+	// Close the connection pools which are no longer used and forget whether their databases were up
+	s.stopPingers()
+	used := make(map[string]bool, len(dbs))
+	for key := range dbs {
+		used[key.String()] = true
+	}
+	for key, db := range s.dbs {
+		if dbs[key] != db {
+			closeDatabase(key, db)
+		}
+		if !used[key.String()] {
+			dbUp.DeleteLabelValues(key.String(), key.flavor())
+		}
+	}
+	s.dbs = dbs
+	s.startPingers(config)
+
+	// Replace the metrics of queries which are no longer running with the metrics of the config
+	kept := make([]Query, 0, len(s.running))
+	for _, running := range s.running {
+		kept = append(kept, running.conf)
+	}
+	unregisterUnusedMetrics(kept)
+
+	// Register the metrics of the queries which are not running yet. Queries whose metric can't be registered
+	// are skipped, they never run so neither /ready nor the queries depending on them wait for them.
+	starting := make(map[string]bool)
+	for _, conf := range config.Queries {
+		if _, ok := s.running[conf.Name]; ok {
+			continue
+		}
+		if err := registerQueryMetric(conf); err != nil {
+			queryReadiness.succeeded(conf.Name)
+			errs = append(errs, err)
+			continue
+		}
+		starting[conf.Name] = true
+	}
+
+	// The exporter is ready once every query has succeeded at least once. The added queries are marked as not
+	// succeeded yet before starting any of them, so queries depending on a query started after them wait for it.
+	// Restarted queries which succeeded before keep counting as succeeded.
+	for name := range starting {
+		if !stopping[name] {
+			queryReadiness.expect(name)
+		}
+	}
+
+	// The Nth query started is delayed by N times query_start_delay, so queries sharing an interval run spaced out.
+	// Queries which keep running don't count, a query added by a reload starts right away when nothing else starts.
+	index := 0
+	for _, conf := range config.Queries {
+		if !starting[conf.Name] {
+			continue
+		}
+		key := queryDBKey(config, conf)
+		s.start(conf, key, dbs[key], time.Duration(index)*config.Query_Start_Delay)
+		index++
+	}
+
+	// Report how many of the configured queries run, queries which couldn't be started are neither active nor disabled
+	queriesConfigured.Set(float64(len(config.Queries) + config.disabledQueries))
+	queriesActive.Set(float64(len(s.running)))
+	queriesDisabled.Set(float64(config.disabledQueries))
+
+	if len(errs) > 0 {
+		return &partialApplyError{errs: errs}
+	}
+	return nil
+}
+
+// start starts the goroutine of a query running on the database key, delaying its first run by delay
+// plus its jitter. s.mu must be held.
+func (s *scheduler) start(conf Query, key dbKey, db *sql.DB, delay time.Duration) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	running := &runningQuery{conf: conf, db: db, cancel: cancel, done: make(chan struct{})}
+	s.running[conf.Name] = running
+
+	// Start a goroutine that periodically runs the query
+	go func() {
+		defer close(running.done)
+
+		// Track the running goroutines, so silently exited goroutines can be noticed
+		queryGoroutineActive.WithLabelValues(conf.Name).Set(1)
+		queryGoroutines.Inc()
+		defer func() {
+			queryGoroutineActive.WithLabelValues(conf.Name).Set(0)
+			queryGoroutines.Dec()
+		}()
+
+		// Delay the first run by the start delay and a random jitter so queries sharing an interval don't all fire at once
+		jitter := jitterDelay(conf.Interval, conf.Jitter_Percent)
+		queryJitter.WithLabelValues(conf.Name).Set(jitter.Seconds())
+		queryStatuses.track(conf, key.String(), time.Now().Add(delay+jitter))
+		if delay+jitter > 0 {
+			select {
+			case <-time.After(delay + jitter):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// Hold back the first run until the queries this query depends on have succeeded once
+		if len(conf.Depends_On) > 0 {
+			queryLogger(conf).Debug("Waiting for dependencies", "depends_on", conf.Depends_On)
+			if !queryReadiness.waitFor(ctx, conf.Depends_On) {
+				return
+			}
+		}
+
+		// Restart the query loop after a delay when it panics, so one bad query doesn't crash the exporter
+		for runQueryLoop(ctx, db, key, conf) {
+			select {
+			case <-time.After(panicRestartDelay):
+			case <-ctx.Done():
+				return
+			}
+			queryLogger(conf).Info("Restarting query after panic")
+		}
+	}()
+}
+
+// runQueryLoop runs a query right away and then every interval until ctx is cancelled.
+// It recovers from panics while running the query and reports whether it stopped because of one.
+func runQueryLoop(ctx context.Context, db *sql.DB, key dbKey, conf Query) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			queryLogger(conf).Error("Query panicked", "error", r, "stack", string(debug.Stack()))
+			queryPanics.WithLabelValues(conf.Name).Inc()
+			panicked = true
+		}
+	}()
+
+	// The first run doesn't wait for the ticker, so the metrics are exported as soon as possible
+	checkQuery(ctx, db, key, conf)
+
+	ticker := time.NewTicker(conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			queryLogger(conf).Debug("Received done signal. Exiting goroutine...")
+			// Clean up and stop go routine
+			return false
+		case <-ticker.C:
+			checkQuery(ctx, db, key, conf)
+		}
+	}
+}
+
+// jitterDelay returns a random duration in [0, interval * percent / 100].
+// crypto/rand is used so exporters started at the same time don't pick correlated delays.
+func jitterDelay(interval time.Duration, percent float64) time.Duration {
+	max := int64(float64(interval) * percent / 100)
+	if max <= 0 {
+		return 0
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(max+1))
+	if err != nil {
+		slog.Error("Error generating jitter, starting without delay", "error", err)
+		return 0
+	}
+	return time.Duration(n.Int64())
+}
+
+// startPingers starts a goroutine per connection pool in s.dbs pinging it right away and then every shortest interval
+// of the queries of config running on it, so mysql_query_exporter_db_up is updated once per batch of queries rather
+// than by every query. The pings are bounded by the shortest connection_timeout of those queries. s.mu must be held.
+func (s *scheduler) startPingers(config Config) {
+	type pingSchedule struct {
+		interval, timeout time.Duration
+	}
+	schedules := make(map[dbKey]pingSchedule)
+	for _, conf := range config.Queries {
+		key := queryDBKey(config, conf)
+		schedule, ok := schedules[key]
+		if !ok || conf.Interval < schedule.interval {
+			schedule.interval = conf.Interval
+		}
+		if conf.Connection_Timeout > 0 && (schedule.timeout == 0 || conf.Connection_Timeout < schedule.timeout) {
+			schedule.timeout = conf.Connection_Timeout
+		}
+		schedules[key] = schedule
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	var wg sync.WaitGroup
+	for key, schedule := range schedules {
+		db, ok := s.dbs[key]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(key dbKey, db *sql.DB, schedule pingSchedule) {
+			defer wg.Done()
+			for {
+				if err := pingDatabase(ctx, db, key, schedule.timeout); err != nil && ctx.Err() == nil {
+					slog.Warn("Database ping failed", "database", key.String(), "error", err)
+				}
+				if schedule.interval <= 0 {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(schedule.interval):
+				}
+			}
+		}(key, db, schedule)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	s.pingCancel, s.pingDone = cancel, done
+}
+
+// stopPingers stops the goroutines started by startPingers and waits for them to exit. s.mu must be held.
+func (s *scheduler) stopPingers() {
+	if s.pingCancel == nil {
+		return
+	}
+	s.pingCancel()
+	<-s.pingDone
+	s.pingCancel, s.pingDone = nil, nil
+}
+
+// databases returns a copy of the open connection pools.
+func (s *scheduler) databases() map[dbKey]*sql.DB {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dbs := make(map[dbKey]*sql.DB, len(s.dbs))
+	for key, db := range s.dbs {
+		dbs[key] = db
+	}
+	return dbs
+}
+
+// stop cancels every query goroutine, waits for them to exit and closes all connection pools, so no
+// query is cut off mid-flight. Goroutines still running after timeout are abandoned with a warning
+// and the connection pools are left open, as closing them would wait for those queries too.
+func (s *scheduler) stop(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, running := range s.running {
+		running.cancel()
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for _, running := range s.running {
+		select {
+		case <-running.done:
+		case <-deadline.C:
+			var pending []string
+			for name, running := range s.running {
+				select {
+				case <-running.done:
+				default:
+					pending = append(pending, name)
+				}
+			}
+			sort.Strings(pending)
+			slog.Warn("Shutdown timeout reached, exiting with queries still running", "queries", pending)
+			return
+		}
+		queryLogger(running.conf).Debug("Query stopped")
+	}
+	s.stopPingers()
+	closeDatabases(s.dbs)
+}
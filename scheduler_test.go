@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunQueryLoopRunsImmediately(t *testing.T) {
+	db, key := openTestDatabase(t)
+	conf := Query{Name: "immediate_run", Query: "SELECT 1", Interval: time.Hour}
+	queryStatuses.track(conf, key.String(), time.Now())
+	t.Cleanup(func() { queryStatuses.forget(conf.Name) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		done <- runQueryLoop(ctx, db, key, conf)
+	}()
+
+	// The first run would be an hour away if it waited for the ticker
+	ran := false
+	for deadline := time.Now().Add(5 * time.Second); !ran && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, state := range queryStatuses.snapshot() {
+			ran = ran || state.Name == conf.Name && !state.LastRun.IsZero()
+		}
+	}
+	cancel()
+	if panicked := <-done; panicked {
+		t.Error("query loop panicked")
+	}
+	if !ran {
+		t.Error("query didn't run before its first interval")
+	}
+}
+
+func TestRunQueryLoopWaitsOneInterval(t *testing.T) {
+	db, key := openTestDatabase(t)
+	conf := Query{Name: "interval_wait", Query: "SELECT 1", Interval: 200 * time.Millisecond}
+	queryStatuses.track(conf, key.String(), time.Now())
+	t.Cleanup(func() { queryStatuses.forget(conf.Name) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		done <- runQueryLoop(ctx, db, key, conf)
+	}()
+
+	// Record the start of the first two runs
+	var runs []time.Time
+	for deadline := time.Now().Add(5 * time.Second); len(runs) < 2 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		for _, state := range queryStatuses.snapshot() {
+			if state.Name == conf.Name && !state.LastRun.IsZero() && (len(runs) == 0 || state.LastRun.After(runs[len(runs)-1])) {
+				runs = append(runs, state.LastRun)
+			}
+		}
+	}
+	cancel()
+	if panicked := <-done; panicked {
+		t.Error("query loop panicked")
+	}
+
+	// A 200ms interval multiplied by time.Second would wait 6 years for the second run
+	if len(runs) < 2 {
+		t.Fatal("query didn't run a second time within 5s")
+	}
+	if wait := runs[1].Sub(runs[0]); wait < 150*time.Millisecond || wait > time.Second {
+		t.Errorf("second run %s after the first, want 200ms", wait)
+	}
+}
+
+// startTestScheduler returns a scheduler running config on an in-memory SQLite database, stopped at the end of the test.
+// The queries of config are forgotten once the test ends, so they don't leak into other tests.
+func startTestScheduler(t *testing.T, config Config) (*scheduler, error) {
+	t.Helper()
+	config.DB_Type, config.DB_Host = dbTypeSQLite, ":memory:"
+	s := newScheduler(context.Background())
+	err := s.apply(config)
+	t.Cleanup(func() {
+		if err := s.apply(Config{DB_Type: dbTypeSQLite, DB_Host: ":memory:"}); err != nil {
+			t.Error(err)
+		}
+		s.stop(5 * time.Second)
+	})
+	return s, err
+}
+
+func TestApplySkipsQueriesWhoseMetricFailsToRegister(t *testing.T) {
+	// The metric name is taken by a metric of the exporter with other labels
+	broken := Query{Name: "broken", Query: "SELECT 1", Interval: time.Hour, Metric_Name: "mysql_query_exporter_db_up"}
+	dependent := Query{Name: "dependent", Query: "SELECT 1", Interval: time.Hour, Depends_On: []string{"broken"}}
+
+	s, err := startTestScheduler(t, Config{Queries: []Query{broken, dependent}})
+	var partial *partialApplyError
+	if !errors.As(err, &partial) || !strings.Contains(err.Error(), "mysql_query_exporter_db_up") {
+		t.Errorf("got error %v, want the registration error of broken applied partially", err)
+	}
+	s.mu.Lock()
+	_, running := s.running[dependent.Name]
+	s.mu.Unlock()
+	if !running {
+		t.Error("dependent isn't running")
+	}
+
+	// The query which never runs is not waited for, neither by /ready nor by the queries depending on it
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if len(queryReadiness.pendingQueries()) == 0 {
+			return
+		}
+	}
+	t.Errorf("queries %v are still pending", queryReadiness.pendingQueries())
+}
+
+func TestApplyKeepsRunningQueriesOnInvalidMetricSettings(t *testing.T) {
+	steady := Query{Name: "steady", Query: "SELECT 1", Interval: time.Hour}
+	s, err := startTestScheduler(t, Config{Queries: []Query{steady}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Extra labels which weren't registered at startup can't be added to the shared metrics
+	changed := steady
+	changed.Interval = time.Minute
+	broken := Query{Name: "broken", Query: "SELECT 1", Interval: time.Hour, Extra_Labels: map[string]string{"added_later": "x"}}
+	err = s.apply(Config{DB_Type: dbTypeSQLite, DB_Host: ":memory:", Queries: []Query{changed, broken}})
+	var partial *partialApplyError
+	if err == nil || errors.As(err, &partial) || !strings.Contains(err.Error(), "added_later") {
+		t.Errorf("got error %v, want the extra label error of broken", err)
+	}
+
+	// steady isn't stopped for a config which can't be applied
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if running, ok := s.running[steady.Name]; !ok || running.conf.Interval != steady.Interval {
+		t.Errorf("steady was changed or stopped")
+	}
+	if _, ok := s.running[broken.Name]; ok {
+		t.Errorf("broken was started")
+	}
+}
+
+// pingCountingDriver is a database/sql driver counting the pings of its connections, which can't run queries.
+type pingCountingDriver struct {
+	pings atomic.Int64
+}
+
+// Driver registered as ping_counting
+var pingCounter = &pingCountingDriver{}
+
+func init() {
+	sql.Register("ping_counting", pingCounter)
+}
+
+func (d *pingCountingDriver) Open(string) (driver.Conn, error) {
+	return pingCountingConn{d}, nil
+}
+
+type pingCountingConn struct {
+	driver *pingCountingDriver
+}
+
+func (c pingCountingConn) Ping(context.Context) error {
+	c.driver.pings.Add(1)
+	return nil
+}
+
+func (pingCountingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("queries are not supported")
+}
+
+func (pingCountingConn) Close() error {
+	return nil
+}
+
+func (pingCountingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func TestPingersPingOncePerBatch(t *testing.T) {
+	db, err := sql.Open("ping_counting", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Three queries share the pool, the shortest interval sets the pace of the pings
+	config := Config{DB_Type: dbTypeSQLite, DB_Host: ":memory:", Queries: []Query{
+		{Name: "batch_first", Query: "SELECT 1", Interval: 100 * time.Millisecond},
+		{Name: "batch_second", Query: "SELECT 1", Interval: 100 * time.Millisecond},
+		{Name: "batch_slow", Query: "SELECT 1", Interval: time.Hour},
+	}}
+	key := queryDBKey(config, config.Queries[0])
+	s := newScheduler(context.Background())
+	s.dbs[key] = db
+	before := pingCounter.pings.Load()
+	s.mu.Lock()
+	s.startPingers(config)
+	s.mu.Unlock()
+
+	// Running a query doesn't ping the database
+	time.Sleep(250 * time.Millisecond)
+	checkQuery(context.Background(), db, key, config.Queries[0])
+	s.mu.Lock()
+	s.stopPingers()
+	s.mu.Unlock()
+
+	// Pings at 0, 100ms and 200ms, a ping per query would count 3 times as many
+	if pings := pingCounter.pings.Load() - before; pings < 2 || pings > 4 {
+		t.Errorf("counted %d pings in 250ms, want one per 100ms", pings)
+	}
+	t.Cleanup(func() { dbUp.DeleteLabelValues(key.String(), key.flavor()) })
+}
+
+func TestApplyKeepsReadinessOfRestartedQueries(t *testing.T) {
+	steady := Query{Name: "ready_steady", Query: "SELECT 1", Interval: time.Hour}
+	s, err := startTestScheduler(t, Config{Queries: []Query{steady}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !queryReadiness.waitFor(ctx, []string{steady.Name}) {
+		t.Fatal("steady didn't succeed")
+	}
+
+	// The restarted query succeeded before, only the added query, which fails, holds back /ready
+	changed := steady
+	changed.Interval = time.Minute
+	added := Query{Name: "ready_added", Query: "SELECT COUNT(*) FROM missing_table", Interval: time.Hour}
+	if err := s.apply(Config{DB_Type: dbTypeSQLite, DB_Host: ":memory:", Queries: []Query{changed, added}}); err != nil {
+		t.Fatal(err)
+	}
+	if pending := queryReadiness.pendingQueries(); !slices.Equal(pending, []string{added.Name}) {
+		t.Errorf("pending queries %v, want only %s", pending, added.Name)
+	}
+}
+
+func TestApplyStaggersOnlyStartedQueries(t *testing.T) {
+	config := Config{Query_Start_Delay: time.Hour, Queries: []Query{
+		{Name: "stagger_first", Query: "SELECT 1", Interval: time.Hour},
+		{Name: "stagger_second", Query: "SELECT 1", Interval: time.Hour},
+	}}
+	s, err := startTestScheduler(t, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The added query is the only one starting, so it isn't delayed by the queries before it
+	added := Query{Name: "stagger_added", Query: "SELECT 1", Interval: time.Hour}
+	config.DB_Type, config.DB_Host = dbTypeSQLite, ":memory:"
+	config.Queries = append(config.Queries, added)
+	if err := s.apply(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delayed by its position in the config, it would first run in 2h
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, state := range queryStatuses.snapshot() {
+			if state.Name == added.Name && !state.LastRun.IsZero() {
+				return
+			}
+		}
+	}
+	t.Errorf("%s didn't run right away", added.Name)
+}
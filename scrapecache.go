@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Maximum duration a scrape waits for the metrics to be gathered when scrape_timeout is not configured
+const defaultScrapeTimeout = 5 * time.Second
+
+// The scrape_timeout of the config, zero when it isn't set, updated on every config (re)load
+var scrapeTimeout atomic.Int64
+
+// Scrapes served from the cache, registered at startup
+var cachedScrapes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mysql_query_exporter_cached_scrapes_total",
+	Help: "The number of scrapes served the metrics gathered last, because gathering took longer than scrape_timeout.",
+})
+
+func init() {
+	prometheus.MustRegister(cachedScrapes)
+}
+
+// setScrapeTimeout sets how long scrapes wait for the metrics to be gathered to the scrape_timeout of config.
+func setScrapeTimeout(config Config) {
+	scrapeTimeout.Store(int64(config.Scrape_Timeout))
+}
+
+// scrapeCache is a gatherer keeping the metrics it gathered last. A scrape waits for at most scrape_timeout
+// for the metrics to be gathered and is served the cached metrics otherwise, so a collector blocked while a slow
+// query holds its lock doesn't make the scrape of Prometheus time out. A single gather runs at a time, scrapes
+// arriving while it runs wait for it rather than starting another one.
+type scrapeCache struct {
+	gatherer prometheus.Gatherer
+
+	mu       sync.Mutex
+	families []*dto.MetricFamily
+	err      error
+	gathered bool
+	// Closed once the running gather finished, nil when no gather runs
+	gathering chan struct{}
+}
+
+// newScrapeCache returns a scrapeCache of the metrics of gatherer, which has gathered nothing yet.
+func newScrapeCache(gatherer prometheus.Gatherer) *scrapeCache {
+	return &scrapeCache{gatherer: gatherer}
+}
+
+// Gather implements prometheus.Gatherer. The returned metrics are shared by the scrapes served from the cache,
+// so they must not be modified.
+func (c *scrapeCache) Gather() ([]*dto.MetricFamily, error) {
+	c.mu.Lock()
+	done := c.gathering
+	if done == nil {
+		done = make(chan struct{})
+		c.gathering = done
+		go c.refresh(done)
+	}
+	c.mu.Unlock()
+
+	timeout := durationOrDefault(time.Duration(scrapeTimeout.Load()), defaultScrapeTimeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		cachedScrapes.Inc()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.gathered {
+		return nil, fmt.Errorf("gathering the metrics took longer than the scrape_timeout of %s", timeout)
+	}
+	return c.families, c.err
+}
+
+// refresh gathers the metrics into the cache and closes done.
+func (c *scrapeCache) refresh(done chan struct{}) {
+	families, err := c.gatherer.Gather()
+
+	c.mu.Lock()
+	c.families, c.err, c.gathered = families, err, true
+	c.gathering = nil
+	c.mu.Unlock()
+	close(done)
+}
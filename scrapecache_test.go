@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestScrapeCache(t *testing.T) {
+	scrapeTimeout.Store(int64(50 * time.Millisecond))
+	t.Cleanup(func() { scrapeTimeout.Store(0) })
+
+	// Every gather returns the family named next, once release is sent
+	release := make(chan string)
+	cache := newScrapeCache(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		name := <-release
+		return []*dto.MetricFamily{{Name: &name}}, nil
+	}))
+	gather := func() (string, error) {
+		families, err := cache.Gather()
+		if len(families) == 0 {
+			return "", err
+		}
+		return families[0].GetName(), err
+	}
+
+	// Nothing can be served before the first gather finished
+	if _, err := gather(); err == nil {
+		t.Fatal("scrape timing out before the first gather succeeded")
+	}
+
+	// The scrape arriving while the first gather runs waits for it
+	results := make(chan string)
+	go func() {
+		name, _ := gather()
+		results <- name
+	}()
+	release <- "first"
+	if name := <-results; name != "first" {
+		t.Errorf("got %q, want the gathered first", name)
+	}
+
+	// A gather taking longer than scrape_timeout serves the cached metrics
+	before := cachedScrapeCount(t)
+	if name, err := gather(); err != nil || name != "first" {
+		t.Errorf("got %q, %v, want the cached first", name, err)
+	}
+	if count := cachedScrapeCount(t) - before; count != 1 {
+		t.Errorf("counted %g cached scrapes, want 1", count)
+	}
+
+	// The slow gather is reused rather than restarted, the next scrape gets its result
+	go func() { release <- "second" }()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if name, _ := gather(); name == "second" {
+			return
+		}
+	}
+	t.Error("the metrics of the slow gather were never served")
+}
+
+// cachedScrapeCount returns the value of mysql_query_exporter_cached_scrapes_total.
+func cachedScrapeCount(t *testing.T) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := cachedScrapes.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetCounter().GetValue()
+}
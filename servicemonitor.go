@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ServiceMonitor resource of the Prometheus Operator, limited to the fields generate-service-monitor sets
+type serviceMonitor struct {
+	APIVersion string                 `yaml:"apiVersion"`
+	Kind       string                 `yaml:"kind"`
+	Metadata   serviceMonitorMetadata `yaml:"metadata"`
+	Spec       serviceMonitorSpec     `yaml:"spec"`
+}
+
+type serviceMonitorMetadata struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+type serviceMonitorSpec struct {
+	Selector  serviceMonitorSelector   `yaml:"selector"`
+	Endpoints []serviceMonitorEndpoint `yaml:"endpoints"`
+}
+
+type serviceMonitorSelector struct {
+	MatchLabels map[string]string `yaml:"matchLabels"`
+}
+
+type serviceMonitorEndpoint struct {
+	Port       string                   `yaml:"port,omitempty"`
+	TargetPort int                      `yaml:"targetPort,omitempty"`
+	Path       string                   `yaml:"path"`
+	Scheme     string                   `yaml:"scheme"`
+	Interval   string                   `yaml:"interval,omitempty"`
+	TLSConfig  *serviceMonitorTLSConfig `yaml:"tlsConfig,omitempty"`
+	BasicAuth  *serviceMonitorBasicAuth `yaml:"basicAuth,omitempty"`
+}
+
+type serviceMonitorTLSConfig struct {
+	ServerName         string `yaml:"serverName,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+}
+
+type serviceMonitorBasicAuth struct {
+	Username serviceMonitorSecretKey `yaml:"username"`
+	Password serviceMonitorSecretKey `yaml:"password"`
+}
+
+// serviceMonitorSecretKey references a key of a Secret in the namespace of the ServiceMonitor.
+type serviceMonitorSecretKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+// generateServiceMonitor runs the generate-service-monitor subcommand with the arguments following it.
+// It writes a ServiceMonitor scraping the exporter as configured to out, or the problem to errOut,
+// and reports whether it succeeded.
+func generateServiceMonitor(args []string, out io.Writer, errOut io.Writer) bool {
+	flags := flag.NewFlagSet("generate-service-monitor", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	configPath := flags.String("config", defaultConfigPath(), "path or http(s) URL of the YAML, JSON or TOML configuration file, MQCE_CONFIG sets the default")
+	configFormat := flags.String("config-format", "", "format of the configuration file: yaml, json or toml (default detected from the file extension)")
+	configAuthToken := flags.String("config-auth-token", "", "bearer token sent when fetching the configuration from a URL")
+	name := flags.String("name", "mysql-query-exporter", "name of the ServiceMonitor")
+	namespace := flags.String("namespace", "", "namespace of the ServiceMonitor (default the namespace it is applied to)")
+	selector := flags.String("selector", "app.kubernetes.io/name=mysql-query-exporter", "comma separated key=value labels of the Service of the exporter")
+	portName := flags.String("port-name", "", "name of the Service port of the exporter (default the exporter_port of the configuration as target port)")
+	interval := flags.String("interval", "30s", "scrape interval")
+	serverName := flags.String("tls-server-name", "", "server name the certificate of the exporter is verified against, when web TLS is configured")
+	insecureSkipVerify := flags.Bool("tls-insecure-skip-verify", false, "skip verifying the certificate of the exporter, when web TLS is configured")
+	basicAuthSecret := flags.String("basic-auth-secret", "", "Secret holding the username and password keys for basic authentication (default <name>-basic-auth)")
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+
+	config, err := loadConfig(*configPath, *configFormat, *configAuthToken)
+	if err != nil {
+		fmt.Fprintf(errOut, "Error reading configuration file %s: %v\n", *configPath, err)
+		return false
+	}
+	if configMode(config) == modePush {
+		fmt.Fprintf(errOut, "The exporter serves no metrics in mode %s, they are pushed to the Pushgateway\n", modePush)
+		return false
+	}
+
+	labels, err := parseLabelSelector(*selector)
+	if err != nil {
+		fmt.Fprintf(errOut, "Invalid -selector: %v\n", err)
+		return false
+	}
+
+	endpoint := serviceMonitorEndpoint{Path: "/metrics", Scheme: "http", Interval: *interval}
+	if *portName != "" {
+		endpoint.Port = *portName
+	} else {
+		endpoint.TargetPort = config.Exporter_Port
+	}
+
+	// Scrape over HTTPS when the exporter serves TLS, see webtls.go
+	if config.Web_TLS_Cert_File != "" && config.Web_TLS_Key_File != "" {
+		endpoint.Scheme = "https"
+		if *serverName != "" || *insecureSkipVerify {
+			endpoint.TLSConfig = &serviceMonitorTLSConfig{ServerName: *serverName, InsecureSkipVerify: *insecureSkipVerify}
+		}
+	}
+
+	// Only the hash of the password is configured, so the credentials are referenced from a Secret
+	if config.Web_Auth_Username != "" {
+		secret := *basicAuthSecret
+		if secret == "" {
+			secret = *name + "-basic-auth"
+		}
+		endpoint.BasicAuth = &serviceMonitorBasicAuth{
+			Username: serviceMonitorSecretKey{Name: secret, Key: "username"},
+			Password: serviceMonitorSecretKey{Name: secret, Key: "password"},
+		}
+	}
+
+	monitor := serviceMonitor{
+		APIVersion: "monitoring.coreos.com/v1",
+		Kind:       "ServiceMonitor",
+		Metadata:   serviceMonitorMetadata{Name: *name, Namespace: *namespace, Labels: labels},
+		Spec: serviceMonitorSpec{
+			Selector:  serviceMonitorSelector{MatchLabels: labels},
+			Endpoints: []serviceMonitorEndpoint{endpoint},
+		},
+	}
+
+	document, err := yaml.Marshal(monitor)
+	if err != nil {
+		fmt.Fprintf(errOut, "Error generating ServiceMonitor: %v\n", err)
+		return false
+	}
+	if _, err := out.Write(document); err != nil {
+		fmt.Fprintf(errOut, "Error writing ServiceMonitor: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// parseLabelSelector parses comma separated key=value labels, such as app=exporter,tier=monitoring.
+func parseLabelSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(selector, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("label %q must be in key=value form", pair)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
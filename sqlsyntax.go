@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	// The parser needs a driver for the values of literals
+	_ "github.com/pingcap/parser/test_driver"
+)
+
+// Statements a query may start with, as only their results can be exported
+var readStatements = map[string]bool{"SELECT": true, "WITH": true, "SHOW": true, "TABLE": true, "VALUES": true}
+
+// Statements MySQL supports but MariaDB doesn't, rejected by check-config -strict for db_flavor mariadb
+var mysqlOnlyStatements = map[string]bool{"TABLE": true}
+
+// readStatement reports whether statement starts with one of the readStatements, returning rows.
+func readStatement(statement string) bool {
+	return readStatements[firstKeyword(statement)]
+}
+
+// firstKeyword returns the first word of statement in upper case, or an empty string if it has none.
+func firstKeyword(statement string) string {
+	words := strings.FieldsFunc(statement, func(r rune) bool { return !unicode.IsLetter(r) })
+	if len(words) == 0 {
+		return ""
+	}
+	return strings.ToUpper(words[0])
+}
+
+// checkSQLSyntax parses query with the MySQL grammar of the TiDB parser, without connecting to a database.
+// It reports syntax errors, more than one statement and statements which don't return rows.
+// Names of tables, columns and functions are not resolved, so they are only checked by running the query.
+func checkSQLSyntax(query string) error {
+	statements, _, err := parser.New().Parse(query, "", "")
+	if err != nil {
+		// The messages of syntax errors end with a space
+		return errors.New(strings.TrimSpace(err.Error()))
+	}
+
+	switch len(statements) {
+	case 0:
+		return fmt.Errorf("query contains no statement")
+	case 1:
+	default:
+		return fmt.Errorf("multiple statements, found %d", len(statements))
+	}
+
+	// UNION, INTERSECT and EXCEPT of SELECT statements are set operations
+	switch statements[0].(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt, *ast.ShowStmt:
+		return nil
+	}
+	return fmt.Errorf("query starts with %s, must be a SELECT, WITH, SHOW, TABLE or VALUES statement", leadingKeyword(query))
+}
+
+// leadingKeyword returns the first word of query after the leading whitespace and comments, in upper case.
+func leadingKeyword(query string) string {
+	for i := 0; i < len(query); i++ {
+		switch {
+		case unicode.IsSpace(rune(query[i])):
+		case startsComment(query, i):
+			closing, err := skipComment(query, i)
+			if err != nil {
+				return ""
+			}
+			i = closing
+		default:
+			return firstKeyword(query[i:])
+		}
+	}
+	return ""
+}
+
+// startsComment reports whether a comment starts at query[i]. MySQL only reads -- as a comment
+// when it is followed by whitespace or ends the query.
+func startsComment(query string, i int) bool {
+	switch {
+	case query[i] == '#':
+		return true
+	case strings.HasPrefix(query[i:], "/*"):
+		return true
+	case strings.HasPrefix(query[i:], "--"):
+		return i+2 == len(query) || unicode.IsSpace(rune(query[i+2]))
+	}
+	return false
+}
+
+// skipComment returns the offset of the last character of the comment starting at query[start].
+func skipComment(query string, start int) (int, error) {
+	if query[start] == '/' {
+		closing := strings.Index(query[start+2:], "*/")
+		if closing < 0 {
+			return 0, fmt.Errorf("unterminated comment starting at offset %d", start)
+		}
+		return start + 2 + closing + 1, nil
+	}
+
+	// Line comments run until the end of the line
+	if closing := strings.IndexByte(query[start:], '\n'); closing >= 0 {
+		return start + closing, nil
+	}
+	return len(query) - 1, nil
+}
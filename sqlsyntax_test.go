@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSQLSyntax(t *testing.T) {
+	tests := []struct {
+		query string
+		// Part of the error message, empty if the query is valid
+		want string
+	}{
+		{"SELECT COUNT(*) FROM users", ""},
+		{"select count(*) from users where created_at > NOW() - INTERVAL 1 DAY;", ""},
+		{"/* comment */ SELECT 1", ""},
+		{"WITH recent AS (SELECT id FROM orders) SELECT COUNT(*) FROM recent", ""},
+		{"SELECT 1 UNION ALL SELECT 2", ""},
+		{"SELECT status, COUNT(*) FROM orders GROUP BY status", ""},
+		{"SELECT ROW_NUMBER() OVER (ORDER BY id) FROM users", ""},
+		{"SHOW GLOBAL STATUS LIKE 'Threads_connected'", ""},
+		{"TABLE users", ""},
+		{"VALUES ROW(1, 2)", ""},
+		{"SELECT 'a;b'", ""},
+		{"SELEC COUNT(*) FROM users", "line 1 column 5"},
+		{"SELECT COUNT(* FROM users", "line 1"},
+		{"SELECT 'unterminated", "line 1"},
+		{"SELECT 1 FROM users WHERE", "line 1"},
+		{"SELECT 1; SELECT 2", "multiple statements"},
+		{"", "no statement"},
+		{"-- only a comment", "no statement"},
+		{"UPDATE users SET active = 0", "query starts with UPDATE"},
+		{"/* cleanup */ DELETE FROM users", "query starts with DELETE"},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			err := checkSQLSyntax(test.query)
+			switch {
+			case test.want == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+				t.Errorf("got error %v, want %s", err, test.want)
+			}
+		})
+	}
+}
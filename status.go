@@ -0,0 +1,174 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// queryState is the state of a configured query shown on the status page.
+type queryState struct {
+	Name     string
+	Database string
+	Interval time.Duration
+	// Start of the last run, zero until the query ran
+	LastRun time.Time
+	// Values exported by the last successful run
+	LastResults []string
+	// Error of the last run, empty if it succeeded
+	LastError string
+	NextRun   time.Time
+
+	// Values exported by the current run, kept once it succeeds
+	results []string
+}
+
+// queryStatus tracks the state of the configured queries for the status page.
+type queryStatus struct {
+	mu      sync.Mutex
+	queries map[string]*queryState
+}
+
+// Status of the configured queries, reported by /
+var queryStatuses = &queryStatus{queries: make(map[string]*queryState)}
+
+// track starts tracking a query running on database, which first runs at nextRun.
+func (s *queryStatus) track(conf Query, database string, nextRun time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queries[conf.Name] = &queryState{
+		Name:     conf.Name,
+		Database: database,
+		Interval: conf.Interval,
+		NextRun:  nextRun,
+	}
+}
+
+// forget stops tracking a removed query.
+func (s *queryStatus) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.queries, name)
+}
+
+// started records that a run of a query started.
+func (s *queryStatus) started(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state, ok := s.queries[name]; ok {
+		state.LastRun = time.Now()
+		state.results = nil
+	}
+}
+
+// result records a value exported by the current run of a query.
+func (s *queryStatus) result(name string, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state, ok := s.queries[name]; ok {
+		state.results = append(state.results, result)
+	}
+}
+
+// finished records the outcome of the current run of a query and when it runs next.
+// The results of a failed run are discarded, so the results of the last successful run stay visible.
+func (s *queryStatus) finished(name string, err error, nextRun time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state, ok := s.queries[name]; ok {
+		if err != nil {
+			state.LastError = err.Error()
+		} else {
+			state.LastError = ""
+			state.LastResults = state.results
+		}
+		state.results = nil
+		state.NextRun = nextRun
+	}
+}
+
+// snapshot returns a copy of the state of every query, sorted by name.
+func (s *queryStatus) snapshot() []queryState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make([]queryState, 0, len(s.queries))
+	for _, state := range s.queries {
+		copied := *state
+		copied.LastResults = append([]string(nil), state.LastResults...)
+		copied.results = nil
+		states = append(states, copied)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// Template of the status page, reloaded by the browser every 30 seconds
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"timestamp": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>MySQL Count Query Exporter</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>MySQL Count Query Exporter</h1>
+<p>Version {{.Version}}. <a href="/metrics">Metrics</a></p>
+<table>
+<tr><th>Query</th><th>Database</th><th>Interval</th><th>Last run</th><th>Last result</th><th>Last error</th><th>Next run</th></tr>
+{{range .Queries}}<tr>
+<td>{{.Name}}</td>
+<td>{{.Database}}</td>
+<td>{{.Interval}}</td>
+<td>{{timestamp .LastRun}}</td>
+<td>{{range .LastResults}}{{.}}<br>{{end}}</td>
+<td class="error">{{.LastError}}</td>
+<td>{{timestamp .NextRun}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Data rendered by statusTemplate
+type statusPage struct {
+	Version string
+	Queries []queryState
+}
+
+// statusHandler returns a handler serving an HTML page with the configuration and last results of every query.
+func statusHandler(s *queryStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The status page is registered on / which matches every path, so unknown paths are not found
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, statusPage{Version: version, Queries: s.snapshot()}); err != nil {
+			slog.Error("Error writing status page", "error", err)
+		}
+	}
+}
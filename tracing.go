@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the spans wrapping every query execution
+const querySpanName = "mysql_query_exporter.query"
+
+// Tracer of the query spans. It does nothing until setupTracing installs a tracer provider.
+var tracer = otel.Tracer("mysql_query_exporter")
+
+// setupTracing exports the query spans to the OTLP/HTTP collector at endpoint, given either as
+// host:port, which is sent to over HTTPS, or as http(s):// URL. It returns a function flushing
+// the buffered spans and stopping the export. Tracing stays disabled when endpoint is empty.
+func setupTracing(endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var options []otlptracehttp.Option
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid otel_endpoint %s: %w", endpoint, err)
+		}
+		options = append(options, otlptracehttp.WithEndpoint(u.Host))
+		if u.Path != "" && u.Path != "/" {
+			options = append(options, otlptracehttp.WithURLPath(u.Path))
+		}
+		if u.Scheme == "http" {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+	} else {
+		options = append(options, otlptracehttp.WithEndpoint(endpoint))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP trace exporter: %w", err)
+	}
+
+	// Name the service so the spans can be told apart from those of other services
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "mysql_query_exporter")))
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// startQuerySpan starts the span of a single execution of a query on the database key.
+func startQuerySpan(ctx context.Context, key dbKey, conf Query) (context.Context, trace.Span) {
+	return tracer.Start(ctx, querySpanName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.name", key.Database),
+		attribute.String("db.statement", conf.Query),
+		attribute.String("db.system", dbSystem(key.Type)),
+		attribute.String("mysql_query_exporter.query_name", conf.Name),
+	))
+}
+
+// endQuerySpan ends the span of a query execution, marking it as failed when err is not nil.
+func endQuerySpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// exemplarLabels returns the trace and span ID of the span in ctx as exemplar labels,
+// or nil when ctx holds no sampled span.
+func exemplarLabels(ctx context.Context) prometheus.Labels {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() || !spanContext.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{"traceID": spanContext.TraceID().String(), "spanID": spanContext.SpanID().String()}
+}
+
+// addWithExemplar adds value to counter, with the span in ctx as exemplar if there is one.
+func addWithExemplar(ctx context.Context, counter prometheus.Counter, value float64) {
+	if adder, ok := counter.(prometheus.ExemplarAdder); ok {
+		if labels := exemplarLabels(ctx); labels != nil {
+			adder.AddWithExemplar(value, labels)
+			return
+		}
+	}
+	counter.Add(value)
+}
+
+// observeWithExemplar observes value, with the span in ctx as exemplar if there is one.
+func observeWithExemplar(ctx context.Context, observer prometheus.Observer, value float64) {
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+		if labels := exemplarLabels(ctx); labels != nil {
+			exemplarObserver.ObserveWithExemplar(value, labels)
+			return
+		}
+	}
+	observer.Observe(value)
+}
+
+// dbSystem returns the OpenTelemetry db.system of a database type.
+func dbSystem(dbType string) string {
+	switch dbType {
+	case dbTypePostgres:
+		return "postgresql"
+	case dbTypeSQLite:
+		return "sqlite"
+	case dbTypeMSSQL:
+		return "mssql"
+	default:
+		return "mysql"
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Operators of the transform of a query, applied to its results with a numeric operand
+const transformOperators = "+-*/"
+
+// resultTransform is a parsed transform, such as "/ 1048576", applied to every value a query returns.
+type resultTransform struct {
+	operator byte
+	operand  float64
+}
+
+// parseTransform parses a transform made of an operator and a number, such as "/ 1048576" or "* 0.001".
+// Only the four basic arithmetic operators are supported, so a transform can't run arbitrary code.
+func parseTransform(transform string) (resultTransform, error) {
+	transform = strings.TrimSpace(transform)
+	if transform == "" || !strings.ContainsRune(transformOperators, rune(transform[0])) {
+		return resultTransform{}, fmt.Errorf("transform %q must start with one of +, -, * or /", transform)
+	}
+
+	operand, err := strconv.ParseFloat(strings.TrimSpace(transform[1:]), 64)
+	if err != nil {
+		return resultTransform{}, fmt.Errorf("invalid operand in transform %q: %w", transform, err)
+	}
+	if transform[0] == '/' && operand == 0 {
+		return resultTransform{}, fmt.Errorf("transform %q divides by zero", transform)
+	}
+	return resultTransform{operator: transform[0], operand: operand}, nil
+}
+
+// apply returns value with the transform applied.
+func (t resultTransform) apply(value float64) float64 {
+	switch t.operator {
+	case '+':
+		return value + t.operand
+	case '-':
+		return value - t.operand
+	case '*':
+		return value * t.operand
+	default:
+		return value / t.operand
+	}
+}
+
+// transformResult returns a value returned by a query with the transform of the query applied.
+// Queries without a transform export their values unchanged.
+func transformResult(conf Query, value float64) float64 {
+	if conf.Transform == "" {
+		return value
+	}
+	// The transforms have been validated with the config
+	transform, err := parseTransform(conf.Transform)
+	if err != nil {
+		return value
+	}
+	return transform.apply(value)
+}
+
+// expectedResult checks a value returned by a query against the min_expected and max_expected of the query and
+// reports whether it is exported. Unexpected values are logged and counted, and skipped with skip_on_validation_failure,
+// so a result in a plausible but wrong range, like a negative count, doesn't overwrite the last good value.
+func expectedResult(conf Query, value float64) bool {
+	// NaN is neither below nor above the range
+	if conf.Min_Expected != nil && value < *conf.Min_Expected || conf.Max_Expected != nil && value > *conf.Max_Expected {
+		queryLogger(conf).Warn("Query result outside of the expected range", "value", value, "skipped", conf.Skip_On_Validation_Failure)
+		queryValidationFailures.WithLabelValues(conf.Name).Inc()
+		return !conf.Skip_On_Validation_Failure
+	}
+	return true
+}
+
+// clampResult returns a value returned by a query bounded by the clamp_min and clamp_max of the query.
+// Clamped values are logged and counted, as they usually point to bad data in the database.
+func clampResult(conf Query, value float64) float64 {
+	clamped := value
+	if conf.Clamp_Max != nil {
+		clamped = math.Min(*conf.Clamp_Max, clamped)
+	}
+	if conf.Clamp_Min != nil {
+		clamped = math.Max(*conf.Clamp_Min, clamped)
+	}
+
+	// NaN stays NaN, it is neither below nor above a bound
+	if clamped != value && !math.IsNaN(value) {
+		queryLogger(conf).Warn("Query result out of bounds, clamping it", "value", value, "clamped", clamped)
+		queryValueClamped.WithLabelValues(conf.Name).Inc()
+	}
+	return clamped
+}
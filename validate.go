@@ -0,0 +1,565 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Label names set by the exporter itself, which extra labels can't use
+var reservedLabelNames = map[string]bool{"name": true, "query": true, dbHostLabel: true, dbNameLabel: true, "row": true, "column": true}
+
+// Names of MySQL character sets and collations, such as utf8mb4_unicode_ci
+var charsetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// validateConfig checks the required fields and constraints of config.
+// It returns one error per violation so all problems can be reported at once.
+func validateConfig(config Config) []error {
+	var errs []error
+
+	switch configMode(config) {
+	case modePull, modePush, modeBoth:
+	default:
+		errs = append(errs, fmt.Errorf("unknown mode %s, must be one of %s, %s or %s", config.Mode, modePull, modePush, modeBoth))
+	}
+
+	// The HTTP server isn't started in push mode
+	if configMode(config) != modePush && !validPort(config.Exporter_Port) {
+		errs = append(errs, fmt.Errorf("exporter_port must be between 1 and 65535, got %d", config.Exporter_Port))
+	}
+
+	if (configMode(config) == modePush || configMode(config) == modeBoth) && config.Push_Gateway_URL == "" {
+		errs = append(errs, fmt.Errorf("push_gateway_url is required in %s mode", configMode(config)))
+	}
+
+	if config.Default_Interval < 0 {
+		errs = append(errs, fmt.Errorf("default_interval must not be negative, got %s", config.Default_Interval))
+	}
+
+	// URL endpoints need a host to send the traces to
+	if endpoint := config.Otel_Endpoint; strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		if u, err := url.Parse(endpoint); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("otel_endpoint %s is not a valid URL", endpoint))
+		}
+	}
+
+	for _, timeout := range []struct {
+		key   string
+		value time.Duration
+	}{{"web_read_timeout", config.Web_Read_Timeout}, {"web_write_timeout", config.Web_Write_Timeout}, {"web_idle_timeout", config.Web_Idle_Timeout}, {"shutdown_timeout", config.Shutdown_Timeout}, {"scrape_timeout", config.Scrape_Timeout}, {"query_start_delay", config.Query_Start_Delay}} {
+		if timeout.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %s", timeout.key, timeout.value))
+		}
+	}
+
+	if config.Healthcheck_Timeout < 0 {
+		errs = append(errs, fmt.Errorf("healthcheck_timeout must not be negative, got %s", config.Healthcheck_Timeout))
+	}
+
+	// Basic authentication needs both a username and a password hash
+	if (config.Web_Auth_Username == "") != (config.Web_Auth_Password_Hash == "") {
+		errs = append(errs, fmt.Errorf("web_auth_username and web_auth_password_hash must be set together"))
+	} else if config.Web_Auth_Password_Hash != "" {
+		if _, err := bcrypt.Cost([]byte(config.Web_Auth_Password_Hash)); err != nil {
+			errs = append(errs, fmt.Errorf("web_auth_password_hash is not a bcrypt hash: %w", err))
+		}
+	}
+
+	switch config.Log_Format {
+	case "", logFormatText, logFormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("unknown log_format %s, must be one of %s or %s", config.Log_Format, logFormatText, logFormatJSON))
+	}
+	if _, err := parseLogLevel(config.Log_Level); err != nil {
+		errs = append(errs, err)
+	}
+
+	// HTTPS needs both a certificate and a key
+	if (config.Web_TLS_Cert_File == "") != (config.Web_TLS_Key_File == "") {
+		errs = append(errs, fmt.Errorf("web_tls_cert_file and web_tls_key_file must be set together"))
+	}
+
+	// The namespace and subsystem must form a valid metric name
+	if resultName, _ := sharedMetricNames(config); !model.IsValidMetricName(model.LabelValue(resultName)) {
+		errs = append(errs, fmt.Errorf("metric_namespace %s and metric_subsystem %s don't form a valid Prometheus metric name %s", config.Metric_Namespace, config.Metric_Subsystem, resultName))
+	}
+
+	if _, err := compileRelabelConfigs(config.Metric_Relabel_Configs); err != nil {
+		errs = append(errs, err)
+	}
+
+	if !sort.Float64sAreSorted(config.Histogram_Buckets) {
+		errs = append(errs, fmt.Errorf("histogram_buckets must be in increasing order"))
+	}
+
+	if len(config.Queries) == 0 {
+		errs = append(errs, fmt.Errorf("no queries are configured"))
+	}
+
+	// Validate the databases queries can run on
+	connections := make(map[string]bool)
+	for i, db := range config.Databases {
+		field := fmt.Sprintf("databases[%d]", i)
+		if db.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", field))
+		} else if connections[db.Name] {
+			errs = append(errs, fmt.Errorf("%s: name %s is used by more than one database", field, db.Name))
+		}
+		connections[db.Name] = true
+
+		if !validDBType(db.Type) {
+			errs = append(errs, fmt.Errorf("%s: unknown type %s, must be one of %s, %s, %s or %s", field, db.Type, dbTypeMySQL, dbTypePostgres, dbTypeSQLite, dbTypeMSSQL))
+		}
+		errs = append(errs, validateSocket(field+": ", "", db)...)
+		errs = append(errs, validateCharset(field+": ", "", db)...)
+		errs = append(errs, validateFlavor(field+": ", "", db)...)
+		if db.Integrated_Security && db.Type != dbTypeMSSQL {
+			errs = append(errs, fmt.Errorf("%s: integrated_security is only supported by type %s", field, dbTypeMSSQL))
+		}
+		// SQLite databases are files, which have no port
+		if db.Type != dbTypeSQLite && db.Socket == "" && !validPort(db.Port) {
+			errs = append(errs, fmt.Errorf("%s: port must be between 1 and 65535, got %d", field, db.Port))
+		}
+		errs = append(errs, validatePoolSettings(field+": ", "", db)...)
+	}
+
+	// Validate the queries
+	names := make(map[string]bool)
+	metricNames := make(map[string]string)
+	usesDefaultConnection := false
+
+	// Every result metric carries the extra labels of all queries
+	extraLabelKeys := make(map[string]bool)
+	for _, conf := range config.Queries {
+		for key := range conf.Extra_Labels {
+			extraLabelKeys[key] = true
+		}
+	}
+
+	for i, conf := range config.Queries {
+		field := fmt.Sprintf("queries[%d]", i)
+		if conf.Name != "" {
+			field = fmt.Sprintf("query %s", conf.Name)
+		}
+
+		if conf.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", field))
+		} else if names[conf.Name] {
+			errs = append(errs, fmt.Errorf("%s: name is used by more than one query", field))
+		}
+		names[conf.Name] = true
+
+		if conf.Query == "" && len(conf.Statements) == 0 {
+			errs = append(errs, fmt.Errorf("%s: query is required", field))
+		}
+		if len(conf.Statements) > 0 {
+			errs = append(errs, validateStatements(field, conf)...)
+		}
+		if conf.Interval == 0 {
+			errs = append(errs, fmt.Errorf("%s: interval is required when default_interval is not set", field))
+		} else if conf.Interval < 0 {
+			errs = append(errs, fmt.Errorf("%s: interval must be a positive duration such as 30s, got %s", field, conf.Interval))
+		} else if conf.Interval < time.Millisecond {
+			// A bare number is read as nanoseconds, which is almost certainly a missing unit
+			errs = append(errs, fmt.Errorf("%s: interval %s is too short, use a duration with a unit such as 30s", field, conf.Interval))
+		}
+		if conf.Query_Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: query_timeout must not be negative, got %s", field, conf.Query_Timeout))
+		}
+		if conf.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: timeout must not be negative, got %s", field, conf.Timeout))
+		}
+		if conf.Connection_Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: connection_timeout must not be negative, got %s", field, conf.Connection_Timeout))
+		}
+		if conf.Retry_Count < 0 {
+			errs = append(errs, fmt.Errorf("%s: retry_count must not be negative, got %d", field, conf.Retry_Count))
+		}
+		if conf.Retry_Backoff < 0 {
+			errs = append(errs, fmt.Errorf("%s: retry_backoff must not be negative, got %s", field, conf.Retry_Backoff))
+		}
+		if conf.Max_Query_Results < 0 {
+			errs = append(errs, fmt.Errorf("%s: max_query_results must not be negative, got %d", field, conf.Max_Query_Results))
+		}
+		if conf.Jitter_Percent < 0 || conf.Jitter_Percent > 100 {
+			errs = append(errs, fmt.Errorf("%s: jitter_percent must be between 0 and 100, got %g", field, conf.Jitter_Percent))
+		}
+
+		if conf.Connection == "" {
+			usesDefaultConnection = true
+		} else if !connections[conf.Connection] {
+			errs = append(errs, fmt.Errorf("%s: connection %s is not configured in databases", field, conf.Connection))
+		}
+
+		if conf.Transform != "" {
+			if _, err := parseTransform(conf.Transform); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", field, err))
+			}
+		}
+
+		if conf.Clamp_Min != nil && conf.Clamp_Max != nil && *conf.Clamp_Min > *conf.Clamp_Max {
+			errs = append(errs, fmt.Errorf("%s: clamp_min %g must not be greater than clamp_max %g", field, *conf.Clamp_Min, *conf.Clamp_Max))
+		}
+		if conf.Min_Expected != nil && conf.Max_Expected != nil && *conf.Min_Expected > *conf.Max_Expected {
+			errs = append(errs, fmt.Errorf("%s: min_expected %g must not be greater than max_expected %g", field, *conf.Min_Expected, *conf.Max_Expected))
+		}
+		if conf.Skip_On_Validation_Failure && conf.Min_Expected == nil && conf.Max_Expected == nil {
+			errs = append(errs, fmt.Errorf("%s: skip_on_validation_failure requires min_expected or max_expected", field))
+		}
+
+		// A password alone would be ignored, the credentials are only overridden together
+		if conf.Password != "" && conf.User == "" {
+			errs = append(errs, fmt.Errorf("%s: password requires user", field))
+		}
+
+		// SQL Server DSNs name the database the query runs on
+		if dbConfig, err := queryDBConfig(config, conf); err == nil && dbConfig.Type == dbTypeMSSQL && dbConfig.Database == "" {
+			errs = append(errs, fmt.Errorf("%s: database is required for queries on mssql databases", field))
+		}
+
+		switch queryMetricType(conf) {
+		case metricTypeGauge, metricTypeCounter:
+		case metricTypeSummary:
+			// Objectives are set per metric, so summaries can't share the default metric
+			if conf.Metric_Name == "" {
+				errs = append(errs, fmt.Errorf("%s: metric_name is required for metric_type %s", field, metricTypeSummary))
+			}
+			if _, err := summaryObjectives(conf); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", field, err))
+			}
+			if conf.Summary_Max_Age < 0 {
+				errs = append(errs, fmt.Errorf("%s: summary_max_age must not be negative, got %s", field, conf.Summary_Max_Age))
+			}
+			if conf.Summary_Age_Buckets < 0 {
+				errs = append(errs, fmt.Errorf("%s: summary_age_buckets must not be negative, got %d", field, conf.Summary_Age_Buckets))
+			}
+		case metricTypeHistogram:
+			// Histograms have a type of their own, so they can't share the default metric either
+			if conf.Metric_Name == "" {
+				errs = append(errs, fmt.Errorf("%s: metric_name is required for native_histogram queries", field))
+			}
+			if conf.Metric_Type != "" {
+				errs = append(errs, fmt.Errorf("%s: native_histogram can't be combined with metric_type %s", field, conf.Metric_Type))
+			}
+			if factor := conf.Native_Histogram_Bucket_Factor; factor != 0 && factor <= 1 {
+				errs = append(errs, fmt.Errorf("%s: native_histogram_bucket_factor must be greater than 1, got %g", field, factor))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown metric_type %s, must be one of %s, %s or %s", field, conf.Metric_Type, metricTypeGauge, metricTypeCounter, metricTypeSummary))
+		}
+
+		// Multi row queries add a label of their own, which shared metrics don't have
+		if conf.Multi_Row {
+			switch label := conf.Row_Label_Column; {
+			case label == "":
+				errs = append(errs, fmt.Errorf("%s: row_label_column is required for multi_row queries", field))
+			case !model.LabelName(label).IsValid() || strings.HasPrefix(label, "__"):
+				errs = append(errs, fmt.Errorf("%s: row_label_column %s is not a valid Prometheus label name", field, label))
+			case reservedLabelNames[label]:
+				errs = append(errs, fmt.Errorf("%s: row_label_column %s is reserved by the exporter", field, label))
+			case extraLabelKeys[label]:
+				errs = append(errs, fmt.Errorf("%s: row_label_column %s is already used as an extra label", field, label))
+			}
+			if conf.Multi_Column {
+				errs = append(errs, fmt.Errorf("%s: multi_row and multi_column can't be combined", field))
+			}
+			if conf.Metric_Name == "" {
+				errs = append(errs, fmt.Errorf("%s: metric_name is required for multi_row queries", field))
+			}
+		} else if conf.Row_Label_Column != "" {
+			errs = append(errs, fmt.Errorf("%s: row_label_column is only used by multi_row queries", field))
+		}
+
+		for j, alert := range conf.Alerts {
+			alertField := fmt.Sprintf("%s.alerts[%d]", field, j)
+			if _, err := parseAlertCondition(alert.Condition); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", alertField, err))
+			}
+			if alert.Notification_URL == "" && alert.Slack_Webhook_URL == "" {
+				errs = append(errs, fmt.Errorf("%s: notification_url or slack_webhook_url is required", alertField))
+			}
+			for _, webhook := range [][2]string{{"notification_url", alert.Notification_URL}, {"slack_webhook_url", alert.Slack_Webhook_URL}} {
+				if u, err := url.Parse(webhook[1]); webhook[1] != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+					errs = append(errs, fmt.Errorf("%s: %s must be an http:// or https:// URL, got %q", alertField, webhook[0], webhook[1]))
+				}
+			}
+			if _, err := template.New("message").Parse(alert.Message); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid message template: %w", alertField, err))
+			}
+			if alert.Repeat_Interval < 0 {
+				errs = append(errs, fmt.Errorf("%s: repeat_interval must not be negative, got %s", alertField, alert.Repeat_Interval))
+			}
+			if alert.Cooldown_Minutes < 0 {
+				errs = append(errs, fmt.Errorf("%s: cooldown_minutes must not be negative, got %d", alertField, alert.Cooldown_Minutes))
+			}
+		}
+
+		for key := range conf.Extra_Labels {
+			if !model.LabelName(key).IsValid() || strings.HasPrefix(key, "__") {
+				errs = append(errs, fmt.Errorf("%s: extra label %s is not a valid Prometheus label name", field, key))
+			} else if reservedLabelNames[key] {
+				errs = append(errs, fmt.Errorf("%s: extra label %s is reserved by the exporter", field, key))
+			}
+		}
+
+		if conf.Metric_Name != "" {
+			if !model.IsValidMetricName(model.LabelValue(conf.Metric_Name)) {
+				errs = append(errs, fmt.Errorf("%s: metric_name %s is not a valid Prometheus metric name", field, conf.Metric_Name))
+			}
+			if other, ok := metricNames[conf.Metric_Name]; ok {
+				errs = append(errs, fmt.Errorf("%s: metric_name %s is already used by query %s", field, conf.Metric_Name, other))
+			}
+			metricNames[conf.Metric_Name] = conf.Name
+		}
+	}
+
+	// The statements of a query are exported under names of their own, which must not be those of other queries
+	for _, conf := range config.Queries {
+		for _, statement := range statementQueries(conf) {
+			if names[statement.Name] {
+				errs = append(errs, fmt.Errorf("query %s: name %s of statement is used by another query", conf.Name, statement.Name))
+			}
+			names[statement.Name] = true
+		}
+	}
+
+	// Queries may only depend on configured queries, without cycles. names also holds the names of statements.
+	queries := make(map[string]bool, len(config.Queries))
+	for _, conf := range config.Queries {
+		queries[conf.Name] = true
+	}
+	for _, conf := range config.Queries {
+		for _, name := range conf.Depends_On {
+			if !queries[name] {
+				errs = append(errs, fmt.Errorf("query %s: depends_on references unknown or disabled query %s", conf.Name, name))
+			}
+		}
+	}
+	if _, err := dependencyOrder(config.Queries); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, validateDerivedMetrics(config, metricNames)...)
+
+	// Every listen address needs a port of its own and may only filter configured queries and derived metrics
+	filterable := maps.Clone(names)
+	for _, derived := range config.Derived_Metrics {
+		filterable[derived.Name] = true
+	}
+	ports := map[int]string{config.Exporter_Port: "exporter_port"}
+	for i, listen := range config.Listen_Addresses {
+		field := fmt.Sprintf("listen_addresses[%d]", i)
+		if !validPort(listen.Port) {
+			errs = append(errs, fmt.Errorf("%s: port must be between 1 and 65535, got %d", field, listen.Port))
+		} else if other, ok := ports[listen.Port]; ok {
+			errs = append(errs, fmt.Errorf("%s: port %d is already used by %s", field, listen.Port, other))
+		} else {
+			ports[listen.Port] = field
+		}
+		for _, name := range listen.Query_Filter {
+			if !filterable[name] {
+				errs = append(errs, fmt.Errorf("%s: query_filter references unknown query or derived metric %s", field, name))
+			}
+		}
+	}
+
+	// The top-level db_* fields are only required when a query runs on them
+	if usesDefaultConnection {
+		if !validDBType(config.DB_Type) {
+			errs = append(errs, fmt.Errorf("unknown db_type %s, must be one of %s, %s, %s or %s", config.DB_Type, dbTypeMySQL, dbTypePostgres, dbTypeSQLite, dbTypeMSSQL))
+		}
+		errs = append(errs, validateSocket("", "db_", defaultDBConfig(config))...)
+		errs = append(errs, validateCharset("", "db_", defaultDBConfig(config))...)
+		errs = append(errs, validateFlavor("", "db_", defaultDBConfig(config))...)
+		if config.DB_Integrated_Security && config.DB_Type != dbTypeMSSQL {
+			errs = append(errs, fmt.Errorf("db_integrated_security is only supported by db_type %s", dbTypeMSSQL))
+		}
+		if config.DB_Type != dbTypeSQLite && config.DB_Socket == "" && !validPort(config.DB_Port) {
+			errs = append(errs, fmt.Errorf("db_port must be between 1 and 65535, got %d", config.DB_Port))
+		}
+		errs = append(errs, validatePoolSettings("", "db_", defaultDBConfig(config))...)
+	}
+
+	return errs
+}
+
+// validateStatements checks the statements of a query, which are run instead of its query as count queries.
+func validateStatements(field string, conf Query) []error {
+	var errs []error
+	if conf.Query != "" {
+		errs = append(errs, fmt.Errorf("%s: query and statements must not both be set", field))
+	}
+	if conf.Multi_Column || conf.Multi_Row {
+		errs = append(errs, fmt.Errorf("%s: statements can't be combined with multi_column or multi_row", field))
+	}
+
+	reads := 0
+	for i, statement := range conf.Statements {
+		if strings.TrimSpace(statement) == "" {
+			errs = append(errs, fmt.Errorf("%s: statements[%d] must not be empty", field, i))
+		} else if readStatement(statement) {
+			reads++
+		}
+	}
+	if reads == 0 {
+		errs = append(errs, fmt.Errorf("%s: statements must contain a statement returning a result, such as SELECT", field))
+	}
+	return errs
+}
+
+// validateDerivedMetrics checks that the derived metrics have unique, valid names and expressions referencing
+// queries which return a single value. metricNames maps the metric_name of queries to the query using it.
+func validateDerivedMetrics(config Config, metricNames map[string]string) []error {
+	// Count queries and the statements of queries return a single value
+	results := make(map[string]bool)
+	for _, conf := range config.Queries {
+		for _, statement := range statementQueries(conf) {
+			results[statement.Name] = true
+		}
+		if len(conf.Statements) == 0 && !conf.Multi_Column && !conf.Multi_Row {
+			results[conf.Name] = true
+		}
+	}
+
+	shared, sharedColumn := sharedMetricNames(config)
+	var errs []error
+	names := make(map[string]bool)
+	for i, derived := range config.Derived_Metrics {
+		field := fmt.Sprintf("derived_metrics[%d]", i)
+		if derived.Name != "" {
+			field = fmt.Sprintf("derived metric %s", derived.Name)
+		}
+
+		switch {
+		case derived.Name == "":
+			errs = append(errs, fmt.Errorf("%s: name is required", field))
+		case !model.IsValidMetricName(model.LabelValue(derived.Name)):
+			errs = append(errs, fmt.Errorf("%s: name is not a valid Prometheus metric name", field))
+		case names[derived.Name]:
+			errs = append(errs, fmt.Errorf("%s: name is used by more than one derived metric", field))
+		case metricNames[derived.Name] != "":
+			errs = append(errs, fmt.Errorf("%s: name is already the metric_name of query %s", field, metricNames[derived.Name]))
+		case derived.Name == shared || derived.Name == sharedColumn:
+			errs = append(errs, fmt.Errorf("%s: name is already used by the shared query metrics", field))
+		}
+		names[derived.Name] = true
+
+		if derived.Expression == "" {
+			errs = append(errs, fmt.Errorf("%s: expression is required", field))
+			continue
+		}
+		_, queries, err := parseDerivedExpression(derived.Expression)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+			continue
+		}
+		for _, name := range queries {
+			if !results[name] {
+				errs = append(errs, fmt.Errorf("%s: expression references %s, which is not a query returning a single value", field, name))
+			}
+		}
+	}
+	return errs
+}
+
+// validateSocket checks that a database is either reached over a host or over a Unix socket, which only MySQL supports.
+// The PROXY protocol header is only sent over TCP connections to MySQL.
+// prefix is prepended to the errors and keyPrefix to the config keys, e.g. db_ for the top-level db_* fields.
+func validateSocket(prefix string, keyPrefix string, db DBConfig) []error {
+	if db.Socket == "" {
+		if db.Host == "" {
+			return []error{fmt.Errorf("%s%shost is required", prefix, keyPrefix)}
+		}
+		if db.Proxy_Protocol && db.Type != "" && db.Type != dbTypeMySQL {
+			return []error{fmt.Errorf("%s%sproxy_protocol is only supported by %stype %s", prefix, keyPrefix, keyPrefix, dbTypeMySQL)}
+		}
+		return nil
+	}
+
+	var errs []error
+	if strings.TrimSpace(db.Socket) == "" {
+		errs = append(errs, fmt.Errorf("%s%ssocket must not be blank", prefix, keyPrefix))
+	}
+	if db.Host != "" {
+		errs = append(errs, fmt.Errorf("%s%ssocket and %shost must not both be set", prefix, keyPrefix, keyPrefix))
+	}
+	if db.Type != "" && db.Type != dbTypeMySQL {
+		errs = append(errs, fmt.Errorf("%s%ssocket is only supported by %stype %s", prefix, keyPrefix, keyPrefix, dbTypeMySQL))
+	}
+	if db.Proxy_Protocol {
+		errs = append(errs, fmt.Errorf("%s%sproxy_protocol is not supported over %ssocket", prefix, keyPrefix, keyPrefix))
+	}
+	return errs
+}
+
+// validateCharset checks the character set, collation and time zone of a database. The character set and
+// collation are sent to the server, so only names made of letters, digits and underscores are accepted.
+func validateCharset(prefix string, keyPrefix string, db DBConfig) []error {
+	var errs []error
+	for _, setting := range []struct {
+		key   string
+		value string
+	}{{"charset", db.Charset}, {"collation", db.Collation}} {
+		if setting.value != "" && !charsetNamePattern.MatchString(setting.value) {
+			errs = append(errs, fmt.Errorf("%s%s%s %q must only contain letters, digits and underscores", prefix, keyPrefix, setting.key, setting.value))
+		}
+	}
+	if db.Loc != "" {
+		if _, err := time.LoadLocation(db.Loc); err != nil {
+			errs = append(errs, fmt.Errorf("%s%sloc %q is not a valid time zone: %w", prefix, keyPrefix, db.Loc, err))
+		}
+	}
+	return errs
+}
+
+// validateFlavor checks that the flavor of a database is known and only set on MySQL databases.
+func validateFlavor(prefix string, keyPrefix string, db DBConfig) []error {
+	switch {
+	case db.Flavor == "":
+		return nil
+	case db.Flavor != dbFlavorMySQL && db.Flavor != dbFlavorMariaDB:
+		return []error{fmt.Errorf("%s%sflavor %s is unknown, must be %s or %s", prefix, keyPrefix, db.Flavor, dbFlavorMySQL, dbFlavorMariaDB)}
+	case db.Type != "" && db.Type != dbTypeMySQL:
+		return []error{fmt.Errorf("%s%sflavor is only supported by %stype %s", prefix, keyPrefix, keyPrefix, dbTypeMySQL)}
+	}
+	return nil
+}
+
+// validatePoolSettings checks that the connection pool settings of a database are not negative.
+// prefix is prepended to error messages and keyPrefix to the config keys they name.
+func validatePoolSettings(prefix string, keyPrefix string, db DBConfig) []error {
+	var errs []error
+	if db.Max_Open_Conns < 0 {
+		errs = append(errs, fmt.Errorf("%s%smax_open_conns must not be negative, got %d", prefix, keyPrefix, db.Max_Open_Conns))
+	}
+	if db.Max_Idle_Conns < 0 {
+		errs = append(errs, fmt.Errorf("%s%smax_idle_conns must not be negative, got %d", prefix, keyPrefix, db.Max_Idle_Conns))
+	}
+	if db.Conn_Max_Lifetime < 0 {
+		errs = append(errs, fmt.Errorf("%s%sconn_max_lifetime must not be negative, got %s", prefix, keyPrefix, db.Conn_Max_Lifetime))
+	}
+	return errs
+}
+
+// validDBType reports whether t is a supported db_type. An empty type defaults to MySQL.
+func validDBType(t string) bool {
+	switch t {
+	case "", dbTypeMySQL, dbTypePostgres, dbTypeSQLite, dbTypeMSSQL:
+		return true
+	default:
+		return false
+	}
+}
+
+// validPort reports whether port is a valid TCP port number.
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// validTestConfig returns a config validateConfig accepts, which the tests break one rule at a time.
+func validTestConfig() Config {
+	return Config{
+		Exporter_Port: 2112,
+		DB_Host:       "db.example.com",
+		DB_Port:       3306,
+		DB_User:       "exporter",
+		Queries: []Query{
+			{Name: "users", Query: "SELECT COUNT(*) FROM users", Interval: 30 * time.Second},
+			{Name: "orders", Query: "SELECT COUNT(*) FROM orders", Interval: time.Minute},
+		},
+	}
+}
+
+func TestValidateConfigValid(t *testing.T) {
+	if errs := validateConfig(validTestConfig()); len(errs) > 0 {
+		t.Errorf("got errors %v for a valid config", errs)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(config *Config)
+		want   []string
+	}{
+		{
+			name:   "missing name",
+			change: func(config *Config) { config.Queries[0].Name = "" },
+			want:   []string{"queries[0]: name is required"},
+		},
+		{
+			name:   "duplicate names",
+			change: func(config *Config) { config.Queries[1].Name = "users" },
+			want:   []string{"query users: name is used by more than one query"},
+		},
+		{
+			name:   "missing query",
+			change: func(config *Config) { config.Queries[0].Query = "" },
+			want:   []string{"query users: query is required"},
+		},
+		{
+			name:   "zero interval",
+			change: func(config *Config) { config.Queries[0].Interval = 0 },
+			want:   []string{"query users: interval is required when default_interval is not set"},
+		},
+		{
+			name:   "negative interval",
+			change: func(config *Config) { config.Queries[0].Interval = -time.Second },
+			want:   []string{"query users: interval must be a positive duration such as 30s, got -1s"},
+		},
+		{
+			name:   "interval without unit",
+			change: func(config *Config) { config.Queries[0].Interval = 30 },
+			want:   []string{"query users: interval 30ns is too short, use a duration with a unit such as 30s"},
+		},
+		{
+			name:   "negative default_interval",
+			change: func(config *Config) { config.Default_Interval = -time.Minute },
+			want:   []string{"default_interval must not be negative, got -1m0s"},
+		},
+		{
+			name: "unknown query_filter name",
+			change: func(config *Config) {
+				config.Listen_Addresses = []ListenAddress{{Port: 9105, Query_Filter: []string{"users", "invoices"}}}
+			},
+			want: []string{"listen_addresses[0]: query_filter references unknown query or derived metric invoices"},
+		},
+		{
+			name:   "negative scrape_timeout",
+			change: func(config *Config) { config.Scrape_Timeout = -time.Second },
+			want:   []string{"scrape_timeout must not be negative, got -1s"},
+		},
+		{
+			name:   "exporter_port zero",
+			change: func(config *Config) { config.Exporter_Port = 0 },
+			want:   []string{"exporter_port must be between 1 and 65535, got 0"},
+		},
+		{
+			name:   "exporter_port too large",
+			change: func(config *Config) { config.Exporter_Port = 65536 },
+			want:   []string{"exporter_port must be between 1 and 65535, got 65536"},
+		},
+		{
+			name:   "db_port out of range",
+			change: func(config *Config) { config.DB_Port = 70000 },
+			want:   []string{"db_port must be between 1 and 65535, got 70000"},
+		},
+		{
+			name:   "missing db_host",
+			change: func(config *Config) { config.DB_Host = "" },
+			want:   []string{"db_host is required"},
+		},
+		{
+			name:   "no queries",
+			change: func(config *Config) { config.Queries = nil },
+			want:   []string{"no queries are configured"},
+		},
+		{
+			name:   "invalid extra label name",
+			change: func(config *Config) { config.Queries[0].Extra_Labels = map[string]string{"1team": "shop"} },
+			want:   []string{"query users: extra label 1team is not a valid Prometheus label name"},
+		},
+		{
+			name:   "extra label with dash",
+			change: func(config *Config) { config.Queries[0].Extra_Labels = map[string]string{"team-name": "shop"} },
+			want:   []string{"query users: extra label team-name is not a valid Prometheus label name"},
+		},
+		{
+			name:   "reserved extra label",
+			change: func(config *Config) { config.Queries[0].Extra_Labels = map[string]string{"name": "shop"} },
+			want:   []string{"query users: extra label name is reserved by the exporter"},
+		},
+		{
+			name:   "invalid metric name",
+			change: func(config *Config) { config.Queries[0].Metric_Name = "users-total" },
+			want:   []string{"query users: metric_name users-total is not a valid Prometheus metric name"},
+		},
+		{
+			name: "duplicate metric name",
+			change: func(config *Config) {
+				config.Queries[0].Metric_Name = "app_rows"
+				config.Queries[1].Metric_Name = "app_rows"
+			},
+			want: []string{"query orders: metric_name app_rows is already used by query users"},
+		},
+		{
+			name:   "unknown dependency",
+			change: func(config *Config) { config.Queries[0].Depends_On = []string{"missing"} },
+			want:   []string{"query users: depends_on references unknown or disabled query missing"},
+		},
+		{
+			name: "dependency cycle",
+			change: func(config *Config) {
+				config.Queries[0].Depends_On = []string{"orders"}
+				config.Queries[1].Depends_On = []string{"users"}
+			},
+			want: []string{"circular depends_on: users -> orders -> users"},
+		},
+		{
+			name: "every error at once",
+			change: func(config *Config) {
+				config.Exporter_Port = 0
+				config.Queries[0].Name = ""
+				config.Queries[1].Query = ""
+			},
+			want: []string{
+				"exporter_port must be between 1 and 65535, got 0",
+				"queries[0]: name is required",
+				"query orders: query is required",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := validTestConfig()
+			test.change(&config)
+
+			var got []string
+			for _, err := range validateConfig(config) {
+				got = append(got, err.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got errors\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
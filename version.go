@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.gitCommit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+// Defining the build info metric
+var buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mysql_query_exporter_build_info",
+	Help: "A metric with a constant '1' value labeled by version, go_version, git_commit and build_date of the exporter.",
+},
+	[]string{"version", "go_version", "git_commit", "build_date"},
+)
+
+func init() {
+	prometheus.MustRegister(buildInfo)
+	buildInfo.WithLabelValues(version, runtime.Version(), gitCommit, buildDate).Set(1)
+}
+
+// versionString returns the build information printed by -version.
+func versionString() string {
+	return fmt.Sprintf("mysql-query-exporter version %s (commit: %s, built: %s)", version, gitCommit, buildDate)
+}
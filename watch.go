@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Time to wait for further changes before reloading a changed config file
+const configWatchDebounce = 500 * time.Millisecond
+
+// Name of the symlink Kubernetes swaps atomically when a mounted ConfigMap is updated
+const configMapDataDir = "..data"
+
+// watchConfig reloads the config file at path whenever it changes until ctx is cancelled.
+// The parent directory is watched rather than the file itself, as Kubernetes updates mounted ConfigMaps
+// by replacing a symlink and editors often replace files instead of writing them.
+func watchConfig(ctx context.Context, path string, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating config watcher: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("error watching directory %s: %w", dir, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		// Changes arrive as bursts of events, so the reload only runs once the burst is over
+		var debounce *time.Timer
+		defer func() {
+			if debounce != nil {
+				debounce.Stop()
+			}
+		}()
+
+		name := filepath.Base(path)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// Ignore changes to other files in the directory
+				changed := filepath.Base(event.Name)
+				if changed != name && changed != configMapDataDir {
+					continue
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(configWatchDebounce, func() {
+					log.Printf("Config file %s changed, reloading", path)
+					reload()
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Error watching config file", "path", path, "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
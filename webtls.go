@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the web TLS certificate, reloading it when the certificate or key file changes
+// so certificates renewed by tools like cert-manager are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// Modification times of the files the current certificate was loaded from
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// newCertReloader loads the certificate and key and returns a certReloader serving them.
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate and key if either file changed since they were last loaded. r.mu must be held
+// unless r is being created.
+func (r *certReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("error reading web TLS certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error reading web TLS key: %w", err)
+	}
+
+	if r.cert != nil && certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading web TLS certificate: %w", err)
+	}
+
+	if r.cert != nil {
+		log.Printf("Reloaded web TLS certificate %s", r.certFile)
+	}
+	r.cert = &cert
+	r.certModTime, r.keyModTime = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. When the changed files can't be loaded,
+// for example because only one of them was replaced yet, the previous certificate keeps being served.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reload(); err != nil {
+		slog.Error("Error reloading web TLS certificate, keeping the current certificate", "error", err)
+	}
+	return r.cert, nil
+}